@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// planApproval is an approver's ed25519 signature over the plan hash.
+type planApproval struct {
+	Approver  string `json:"approver"`
+	PublicKey string `json:"publicKey"`
+	SignedAt  string `json:"signedAt"`
+	Signature string `json:"signature"`
+}
+
+// generateSigningKey writes a new ed25519 private key as PEM, and returns the public key line for
+// the `approversFile`.
+func generateSigningKey(path string, name string) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return "", err
+	}
+	return name + " " + base64.StdEncoding.EncodeToString(public), nil
+}
+
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return private, nil
+}
+
+// loadTrustedApprovers reads the approvers file, one `name base64-public-key` per line, into a map
+// of public key to name.
+func loadTrustedApprovers(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	trusted := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected `name public-key`", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("line %d: not an ed25519 public key", line)
+		}
+		trusted[fields[1]] = fields[0]
+	}
+	return trusted, scanner.Err()
+}
+
+// newPlanSignature signs the plan hash.
+func newPlanSignature(plan *deletionPlan, name string, key ed25519.PrivateKey, now time.Time) *planApproval {
+	return &planApproval{
+		Approver:  name,
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		SignedAt:  now.UTC().Format(time.RFC3339),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(plan.Hash))),
+	}
+}
+
+// verify checks the signature is over the hash.
+func (a planApproval) verify(hash string) bool {
+	publicKey, err := base64.StdEncoding.DecodeString(a.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(a.Signature)
+	return err == nil && ed25519.Verify(ed25519.PublicKey(publicKey), []byte(hash), signature)
+}
+
+// signPlan adds the approver's signature over the plan hash. The plan's author can not approve it.
+func signPlan(plan *deletionPlan, approver string, key ed25519.PrivateKey, now time.Time) error {
+	approval := newPlanSignature(plan, approver, key, now)
+	if approver == plan.CreatedBy || (plan.Author != nil && plan.Author.PublicKey == approval.PublicKey) {
+		return fmt.Errorf("%s created the plan, and can not also approve it", approver)
+	}
+	for _, existing := range plan.Approvals {
+		if existing.PublicKey == approval.PublicKey {
+			return fmt.Errorf("the plan has already been approved with this key by %s", existing.Approver)
+		}
+	}
+	plan.Approvals = append(plan.Approvals, *approval)
+	return nil
+}
+
+// verifyApprovals checks that the plan was signed by a trusted author, and that at least `required`
+// distinct trusted approvers, other than the author, have signed this exact plan hash. The author
+// is who signed the plan, not the plan's unauthenticated `createdBy`.
+func verifyApprovals(plan *deletionPlan, trusted map[string]string, required int) error {
+	if plan.Author == nil {
+		return fmt.Errorf("plan is not signed by its author, create it with --signingKey")
+	}
+	author, ok := trusted[plan.Author.PublicKey]
+	if !ok {
+		return fmt.Errorf("plan author %s is not a trusted approver", plan.Author.Approver)
+	}
+	if !plan.Author.verify(plan.Hash) {
+		return fmt.Errorf("plan author's signature does not match the plan")
+	}
+
+	approvers := map[string]bool{}
+	for _, approval := range plan.Approvals {
+		name, ok := trusted[approval.PublicKey]
+		if !ok {
+			output(WARNING, true, true, "[A]       : ignoring approval by %s, the key is not trusted", approval.Approver)
+			continue
+		}
+		if name == author {
+			output(WARNING, true, true, "[A]       : ignoring approval by %s, who created the plan", name)
+			continue
+		}
+		if !approval.verify(plan.Hash) {
+			output(WARNING, true, true, "[A]       : ignoring approval by %s, the signature does not match the plan", name)
+			continue
+		}
+		approvers[name] = true
+	}
+	if len(approvers) < required {
+		return fmt.Errorf("plan has %d of the %d required approvals", len(approvers), required)
+	}
+	return nil
+}
+
+// approvalsRequired returns the number of approvals a plan needs before it is applied. With an
+// `approversFile`, or a production profile, at least one approval is always required.
+func approvalsRequired() int {
+	if (*approversFile != "" || productionProfile) && *requiredApprovals < 1 {
+		return 1
+	}
+	return *requiredApprovals
+}
+
+// planApprover is a trusted approver, recorded in the plan when it is created.
+type planApprover struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"`
+}
+
+// trustedApprovers reads the `approversFile`, which is needed when approvals are required.
+func trustedApprovers(required int) (map[string]string, error) {
+	if *approversFile == "" {
+		return nil, fmt.Errorf("the plan needs %d approvals, set the approversFile", required)
+	}
+	return loadTrustedApprovers(*approversFile)
+}
+
+// requireApprovals records the approvals required, and the trusted approvers, in the plan. The
+// author's signature covers them, so they can not be lowered by whoever applies the plan.
+func requireApprovals(plan *deletionPlan, required int) error {
+	if required == 0 {
+		return nil
+	}
+	if *signingKey == "" {
+		return fmt.Errorf("the plan needs %d approvals, sign it with --signingKey", required)
+	}
+	trusted, err := trustedApprovers(required)
+	if err != nil {
+		return err
+	}
+	plan.RequiredApprovals = required
+	plan.Approvers = nil
+	for publicKey, name := range trusted {
+		plan.Approvers = append(plan.Approvers, planApprover{Name: name, PublicKey: publicKey})
+	}
+	sort.Slice(plan.Approvers, func(i, j int) bool {
+		if plan.Approvers[i].Name != plan.Approvers[j].Name {
+			return plan.Approvers[i].Name < plan.Approvers[j].Name
+		}
+		return plan.Approvers[i].PublicKey < plan.Approvers[j].PublicKey
+	})
+	return nil
+}
+
+// recordedApprovers returns the trusted approvers that were also recorded in the plan, or all of
+// them for a plan without any recorded.
+func (p *deletionPlan) recordedApprovers(trusted map[string]string) map[string]string {
+	if len(p.Approvers) == 0 {
+		return trusted
+	}
+	recorded := map[string]string{}
+	for _, approver := range p.Approvers {
+		if name, ok := trusted[approver.PublicKey]; ok {
+			recorded[approver.PublicKey] = name
+		}
+	}
+	return recorded
+}
+
+// approvePlan signs the plan file in place.
+func approvePlan(path string, approver string, keyPath string) error {
+	plan, err := readPlan(path)
+	if err != nil {
+		return err
+	}
+	// An encrypted plan is written back encrypted.
+	if data, err := os.ReadFile(path); err == nil && bytes.HasPrefix(data, []byte(ageHeader)) && len(outputRecipients) == 0 {
+		return fmt.Errorf("plan is encrypted, approve it with --encryptTo")
+	}
+	key, err := loadSigningKey(keyPath)
+	if err != nil {
+		return err
+	}
+	if err := signPlan(plan, approver, key, time.Now()); err != nil {
+		return err
+	}
+	return writePlan(path, plan)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanApprovals(t *testing.T) {
+	dir := t.TempDir()
+	trusted := map[string]string{}
+	keys := map[string]string{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		path := filepath.Join(dir, name+".pem")
+		line, err := generateSigningKey(path, name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		fields := strings.Fields(line)
+		trusted[fields[1]] = fields[0]
+		keys[name] = path
+	}
+
+	plan := testPlan()
+	plan.CreatedBy = "alice"
+	plan.Hash = plan.contentHash()
+
+	aliceKey, _ := loadSigningKey(keys["alice"])
+	if err := signPlan(plan, "alice", aliceKey, time.Now()); err == nil {
+		t.Errorf("expected the plan's author to be refused")
+	}
+	plan.Author = newPlanSignature(plan, "alice", aliceKey, time.Now())
+	// The author is who signed the plan, whatever name they approve under.
+	if err := signPlan(plan, "someone-else", aliceKey, time.Now()); err == nil {
+		t.Errorf("expected the plan's author to be refused under another name")
+	}
+
+	bobKey, _ := loadSigningKey(keys["bob"])
+	if err := signPlan(plan, "bob", bobKey, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := signPlan(plan, "bob", bobKey, time.Now()); err == nil {
+		t.Errorf("expected a second signature with the same key to be refused")
+	}
+	if err := verifyApprovals(plan, trusted, 1); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := verifyApprovals(plan, trusted, 2); err == nil {
+		t.Errorf("expected 1 of 2 approvals to be refused")
+	}
+
+	carolKey, _ := loadSigningKey(keys["carol"])
+	signPlan(plan, "carol", carolKey, time.Now())
+	if err := verifyApprovals(plan, trusted, 2); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Signatures are over the exact plan hash.
+	plan.Users = append(plan.Users, userJob{ID: "b2", Username: "userB"})
+	plan.Hash = plan.contentHash()
+	if err := verifyApprovals(plan, trusted, 1); err == nil {
+		t.Errorf("expected approvals of a different plan to be refused")
+	}
+}
+
+func TestPlanApprovalsNeedATrustedAuthor(t *testing.T) {
+	dir := t.TempDir()
+	trusted := map[string]string{}
+	keys := map[string]string{}
+	for _, name := range []string{"alice", "bob", "mallory"} {
+		path := filepath.Join(dir, name+".pem")
+		line, err := generateSigningKey(path, name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		fields := strings.Fields(line)
+		if name != "mallory" {
+			trusted[fields[1]] = fields[0]
+		}
+		keys[name] = path
+	}
+	aliceKey, _ := loadSigningKey(keys["alice"])
+	bobKey, _ := loadSigningKey(keys["bob"])
+	malloryKey, _ := loadSigningKey(keys["mallory"])
+
+	plan := testPlan()
+	plan.CreatedBy = "carol"
+	plan.Hash = plan.contentHash()
+	signPlan(plan, "bob", bobKey, time.Now())
+	if err := verifyApprovals(plan, trusted, 1); err == nil {
+		t.Errorf("expected a plan without the author's signature to be refused")
+	}
+
+	plan.Author = newPlanSignature(plan, "alice", malloryKey, time.Now())
+	if err := verifyApprovals(plan, trusted, 1); err == nil {
+		t.Errorf("expected a plan signed by an untrusted author to be refused")
+	}
+
+	// createdBy is not trusted, bob signed the plan, so bob's approval does not count.
+	plan.Author = newPlanSignature(plan, "carol", bobKey, time.Now())
+	if err := verifyApprovals(plan, trusted, 1); err == nil {
+		t.Errorf("expected the author's own approval to be ignored")
+	}
+
+	plan.Author = newPlanSignature(plan, "alice", aliceKey, time.Now())
+	if err := verifyApprovals(plan, trusted, 1); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	plan.Author.Signature = plan.Approvals[0].Signature
+	if err := verifyApprovals(plan, trusted, 1); err == nil {
+		t.Errorf("expected a forged author signature to be refused")
+	}
+}
+
+func TestApprovalsRequired(t *testing.T) {
+	defer func(file string, required int) { *approversFile, *requiredApprovals = file, required }(*approversFile, *requiredApprovals)
+
+	*approversFile, *requiredApprovals = "", 0
+	if got := approvalsRequired(); got != 0 {
+		t.Errorf("approvalsRequired() = %d, expected 0 without an approversFile", got)
+	}
+	*approversFile = "approvers.txt"
+	if got := approvalsRequired(); got != 1 {
+		t.Errorf("approvalsRequired() = %d, expected at least 1 with an approversFile", got)
+	}
+	*requiredApprovals = 2
+	if got := approvalsRequired(); got != 2 {
+		t.Errorf("approvalsRequired() = %d, expected 2", got)
+	}
+
+	defer func(production bool) { productionProfile = production }(productionProfile)
+	*approversFile, *requiredApprovals, productionProfile = "", 0, true
+	if got := approvalsRequired(); got != 1 {
+		t.Errorf("approvalsRequired() = %d, expected at least 1 for a production profile", got)
+	}
+}
+
+func TestPlanRecordsApprovals(t *testing.T) {
+	defer func(file string, key string) { *approversFile, *signingKey = file, key }(*approversFile, *signingKey)
+	dir := t.TempDir()
+	keys := map[string]string{}
+	var lines []string
+	for _, name := range []string{"alice", "bob", "carol"} {
+		path := filepath.Join(dir, name+".pem")
+		line, err := generateSigningKey(path, name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		lines = append(lines, line)
+		keys[name] = path
+	}
+	*approversFile = filepath.Join(dir, "approvers.txt")
+	if err := os.WriteFile(*approversFile, []byte(lines[0]+"\n"+lines[1]+"\n"), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	plan := testPlan()
+	*signingKey = ""
+	if err := requireApprovals(plan, 1); err == nil {
+		t.Errorf("expected a plan needing approvals to need a signingKey")
+	}
+	*signingKey = keys["alice"]
+	if err := requireApprovals(plan, 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if plan.RequiredApprovals != 1 || len(plan.Approvers) != 2 {
+		t.Fatalf("requireApprovals() recorded %d approvals from %v", plan.RequiredApprovals, plan.Approvers)
+	}
+	aliceKey, _ := loadSigningKey(keys["alice"])
+	plan.Hash = plan.contentHash()
+	plan.Author = newPlanSignature(plan, "alice", aliceKey, time.Now())
+
+	// The plan's count is enforced, whatever is required when applying it.
+	if err := verifyPlan(plan, plan.URL, plan.Realm, 0); err == nil {
+		t.Errorf("expected an unapproved plan to be refused")
+	}
+	*approversFile = ""
+	if err := verifyPlan(plan, plan.URL, plan.Realm, 0); err == nil {
+		t.Errorf("expected a plan needing approvals to need the approversFile")
+	}
+
+	// carol was added to the approvers after the plan was created, so can't approve it.
+	*approversFile = filepath.Join(dir, "approvers.txt")
+	os.WriteFile(*approversFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	carolKey, _ := loadSigningKey(keys["carol"])
+	signPlan(plan, "carol", carolKey, time.Now())
+	if err := verifyPlan(plan, plan.URL, plan.Realm, 0); err == nil {
+		t.Errorf("expected an approver not recorded in the plan to be ignored")
+	}
+	bobKey, _ := loadSigningKey(keys["bob"])
+	signPlan(plan, "bob", bobKey, time.Now())
+	if err := verifyPlan(plan, plan.URL, plan.Realm, 0); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The recorded count can't be lowered without breaking the author's signature.
+	plan.RequiredApprovals = 0
+	plan.Hash = plan.contentHash()
+	if err := verifyPlan(plan, plan.URL, plan.Realm, 0); err == nil {
+		t.Errorf("expected a plan altered after the author signed it to be refused")
+	}
+}
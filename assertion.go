@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// clientAssertionLifetime is how long a client assertion is valid for, it is only used once.
+const clientAssertionLifetime = time.Minute
+
+// clientAssertion signs the client assertions for private_key_jwt client authentication, nil to
+// authenticate with the client secret.
+var clientAssertion *clientAssertionSigner
+
+type clientAssertionSigner struct {
+	key      interface{}
+	method   jwt.SigningMethod
+	keyId    string
+	audience string
+}
+
+// loadClientAssertion reads the `clientKeyFile`, an RSA key for RS256 or a P-256 EC key for ES256,
+// in PKCS #1, SEC 1 or PKCS #8 PEM. It returns nil when no key file is set.
+func loadClientAssertion(keyFile string, keyId string, audience string) (*clientAssertionSigner, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+		return &clientAssertionSigner{key: key, method: jwt.SigningMethodRS256, keyId: keyId, audience: audience}, nil
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an RSA or EC private key", keyFile)
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%s is a %s key, ES256 needs P-256", keyFile, key.Curve.Params().Name)
+	}
+	return &clientAssertionSigner{key: key, method: jwt.SigningMethodES256, keyId: keyId, audience: audience}, nil
+}
+
+// tokenEndpoint returns the realm's token endpoint, the default audience of a client assertion.
+func tokenEndpoint(baseURL string, realm string, legacy bool) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	if legacy {
+		baseURL += "/auth"
+	}
+	return baseURL + "/realms/" + realm + "/protocol/openid-connect/token"
+}
+
+// sign returns a client assertion for the client, issued by and about the client itself.
+func (s *clientAssertionSigner) sign(clientId string, audience string, now time.Time) (string, error) {
+	if s.audience != "" {
+		audience = s.audience
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(s.method, jwt.RegisteredClaims{
+		Issuer:    clientId,
+		Subject:   clientId,
+		Audience:  jwt.ClaimStrings{audience},
+		ID:        hex.EncodeToString(id),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	})
+	if s.keyId != "" {
+		token.Header["kid"] = s.keyId
+	}
+	return token.SignedString(s.key)
+}
+
+// login gets a token with the client credentials grant, authenticating with a signed JWT rather
+// than the client secret. The audience is the token endpoint of the server at url, the one logged in to.
+func (s *clientAssertionSigner) login(ctx context.Context, client *gocloak.GoCloak, url string, realm string, clientId string) (*gocloak.JWT, error) {
+	assertion, err := s.sign(clientId, tokenEndpoint(url, realm, *useLegacyKeycloak), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return client.GetToken(ctx, realm, gocloak.TokenOptions{
+		ClientID:            &clientId,
+		GrantType:           gocloak.StringP("client_credentials"),
+		ClientAssertionType: gocloak.StringP(CLIENT_ASSERTION_TYPE),
+		ClientAssertion:     &assertion,
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func writeTestKey(t *testing.T, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "client.key")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClientAssertion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDer, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		public crypto.PublicKey
+		alg    string
+	}{
+		{writeTestKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), &rsaKey.PublicKey, "RS256"},
+		{writeTestKey(t, "EC PRIVATE KEY", ecDer), &ecKey.PublicKey, "ES256"},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		signer, err := loadClientAssertion(tt.path, "key-1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertion, err := signer.sign("kc-delete", "https://kc/realms/master/protocol/openid-connect/token", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := &jwt.RegisteredClaims{}
+		token, err := jwt.ParseWithClaims(assertion, claims, func(*jwt.Token) (interface{}, error) { return tt.public, nil })
+		if err != nil {
+			t.Fatalf("%s: %v", tt.alg, err)
+		}
+		if token.Method.Alg() != tt.alg || token.Header["kid"] != "key-1" {
+			t.Errorf("alg=%s kid=%v, want %s key-1", token.Method.Alg(), token.Header["kid"], tt.alg)
+		}
+		if claims.Issuer != "kc-delete" || claims.Subject != "kc-delete" || claims.ID == "" {
+			t.Errorf("claims=%+v", claims)
+		}
+		if len(claims.Audience) != 1 || claims.Audience[0] != "https://kc/realms/master/protocol/openid-connect/token" {
+			t.Errorf("audience=%v", claims.Audience)
+		}
+	}
+
+	// A configured audience replaces the token endpoint.
+	signer, _ := loadClientAssertion(tests[0].path, "", "https://kc/realms/master")
+	assertion, _ := signer.sign("kc-delete", "https://kc/realms/master/protocol/openid-connect/token", now)
+	claims := &jwt.RegisteredClaims{}
+	token, _, err := jwt.NewParser().ParseUnverified(assertion, claims)
+	if err != nil || claims.Audience[0] != "https://kc/realms/master" {
+		t.Errorf("audience=%v err=%v", claims.Audience, err)
+	}
+	if _, ok := token.Header["kid"]; ok {
+		t.Errorf("expected no kid when clientKeyId is not set")
+	}
+}
+
+func TestLoadClientAssertionInvalid(t *testing.T) {
+	if signer, err := loadClientAssertion("", "", ""); signer != nil || err != nil {
+		t.Errorf("signer=%v err=%v, wanted none without a key file", signer, err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(p384)
+	for _, path := range []string{
+		writeTestKey(t, "EC PRIVATE KEY", der),
+		writeTestKey(t, "CERTIFICATE", []byte("not a key")),
+		filepath.Join(t.TempDir(), "missing.key"),
+	} {
+		if _, err := loadClientAssertion(path, "", ""); err == nil {
+			t.Errorf("expected an error for %s", path)
+		}
+	}
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	if got := tokenEndpoint("https://kc/", "master", false); got != "https://kc/realms/master/protocol/openid-connect/token" {
+		t.Errorf("tokenEndpoint=%s", got)
+	}
+	if got := tokenEndpoint("https://kc", "master", true); got != "https://kc/auth/realms/master/protocol/openid-connect/token" {
+		t.Errorf("tokenEndpoint=%s", got)
+	}
+}
+
+func TestReauthenticateWithClientAssertion(t *testing.T) {
+	var grants []string
+	var assertions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		grants = append(grants, r.Form.Get("grant_type"))
+		assertions = append(assertions, r.Form.Get("client_assertion"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"new-access-token","expires_in":60}`))
+	}))
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	clientAssertion, err = loadClientAssertion(writeTestKey(t, "EC PRIVATE KEY", der), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { clientAssertion = nil }()
+
+	client := gocloak.NewClient(server.URL)
+	token, err := reauthenticate(context.Background(), client, server.URL, &gocloak.JWT{RefreshToken: "refresh"}, "master", "kc-delete", "admin", false)
+	if err != nil || token.AccessToken != "new-access-token" {
+		t.Fatalf("token=%v err=%v", token, err)
+	}
+	if len(grants) != 1 || grants[0] != "client_credentials" || assertions[0] == "" {
+		t.Fatalf("grants=%v, wanted a new client assertion rather than a refresh", grants)
+	}
+	// The audience is the server logged in to, not the `url` option.
+	claims := jwt.RegisteredClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(assertions[0], &claims); err != nil {
+		t.Fatal(err)
+	}
+	if want := tokenEndpoint(server.URL, "master", false); len(claims.Audience) != 1 || claims.Audience[0] != want {
+		t.Errorf("audience=%v, wanted %s", claims.Audience, want)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// A backupRecord is a single line of the NDJSON backup file, holding everything needed to recreate
+// the user after deletion.
+type backupRecord struct {
+	RunID               string                                     `json:"runId"`
+	BackedUpAt          string                                     `json:"backedUpAt"`
+	Realm               string                                     `json:"realm"`
+	User                *gocloak.User                              `json:"user"`
+	Groups              []*gocloak.Group                           `json:"groups,omitempty"`
+	RoleMappings        *gocloak.MappingsRepresentation            `json:"roleMappings,omitempty"`
+	FederatedIdentities []*gocloak.FederatedIdentityRepresentation `json:"federatedIdentities,omitempty"`
+}
+
+// backupWriter appends backup records to the per-run backup file. It is shared by all the workers.
+type backupWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openBackupWriter(path string) (*backupWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &backupWriter{file: file}, nil
+}
+
+// Write appends the record as a single line, and syncs it to disk before returning, as the caller
+// is about to delete the user. Each line is encrypted on its own when `--encryptTo` is set.
+func (b *backupWriter) Write(record backupRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if len(outputRecipients) > 0 {
+		if line, err = encryptLine(line, outputRecipients); err != nil {
+			return err
+		}
+	}
+	line = append(line, '\n')
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.file.Write(line); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+func (b *backupWriter) Name() string {
+	return b.file.Name()
+}
+
+func (b *backupWriter) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.file.Close()
+}
+
+// fetchBackupRecord pulls the full representation of the user, along with the groups, role mappings
+// and identity provider links that are not part of the user representation.
+func fetchBackupRecord(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, userID string) (backupRecord, error) {
+	record := backupRecord{
+		RunID:      runId,
+		BackedUpAt: time.Now().UTC().Format(time.RFC3339),
+		Realm:      targetRealm,
+	}
+
+	user, err := client.GetUserByID(ctx, accessToken, targetRealm, userID)
+	if err != nil {
+		return record, fmt.Errorf("get user: %w", err)
+	}
+	record.User = user
+
+	groups, err := client.GetUserGroups(ctx, accessToken, targetRealm, userID, gocloak.GetGroupsParams{})
+	if err != nil {
+		return record, fmt.Errorf("get groups: %w", err)
+	}
+	record.Groups = groups
+
+	mappings, err := client.GetRoleMappingByUserID(ctx, accessToken, targetRealm, userID)
+	if err != nil {
+		return record, fmt.Errorf("get role mappings: %w", err)
+	}
+	record.RoleMappings = mappings
+
+	identities, err := client.GetUserFederatedIdentities(ctx, accessToken, targetRealm, userID)
+	if err != nil {
+		return record, fmt.Errorf("get federated identities: %w", err)
+	}
+	record.FederatedIdentities = identities
+
+	return record, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func TestBackupWriterAppendsLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.ndjson")
+	backup, err := openBackupWriter(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, username := range []string{"userA", "userB"} {
+		record := backupRecord{RunID: "1", Realm: "delete", User: &gocloak.User{Username: gocloak.StringP(username)}}
+		if err := backup.Write(record); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	backup.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, wanted 0600", info.Mode().Perm())
+	}
+
+	file, _ := os.Open(path)
+	defer file.Close()
+	var usernames []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record backupRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		usernames = append(usernames, *record.User.Username)
+	}
+	if len(usernames) != 2 || usernames[0] != "userA" || usernames[1] != "userB" {
+		t.Errorf("got %v, wanted [userA userB]", usernames)
+	}
+}
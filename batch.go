@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+// splitBatches splits the users into batches of at most size users.
+func splitBatches(users []userJob, size int) [][]userJob {
+	if size <= 0 || len(users) <= size {
+		return [][]userJob{users}
+	}
+	var batches [][]userJob
+	for start := 0; start < len(users); start += size {
+		end := start + size
+		if end > len(users) {
+			end = len(users)
+		}
+		batches = append(batches, users[start:end])
+	}
+	return batches
+}
+
+// deleteInBatches runs the worker pool over one batch at a time, waiting `batchPause` between
+// batches. When halted, or stopped after a batch, it returns the users that were not processed.
+func deleteInBatches(users []userJob, checkAge bool, deleteEpochTime int64, backup *backupWriter, results chan string) []userJob {
+	batches := splitBatches(users, *batchSize)
+	done := 0
+	for i, batch := range batches {
+		output(INFO, true, true, "[B][START]: batch %d/%d users=%d", i+1, len(batches), len(batch))
+		notDispatched := deleteUsers(batch, checkAge, deleteEpochTime, backup, results)
+		done += len(batch) - len(notDispatched)
+		if len(notDispatched) > 0 {
+			return users[done:]
+		}
+		output(INFO, true, true, "[B][END]  : batch %d/%d progress=%d/%d deleted=%d", i+1, len(batches), done, len(users), deleted)
+
+		if i == len(batches)-1 {
+			break
+		}
+		if !waitForNextBatch(*batchPause) {
+			return users[done:]
+		}
+	}
+	return nil
+}
+
+// waitForNextBatch waits `pause` before the next batch, returning false when the run is halted or
+// stopped after the batch instead. A stop is a halt by signal, as no batch is running.
+func waitForNextBatch(pause time.Duration) bool {
+	select {
+	case <-stopAfterBatch:
+		halt("signal")
+		return false
+	case <-haltDispatch:
+		return false
+	default:
+	}
+	output(INFO, true, true, "[B]       : pausing %s before the next batch", pause)
+	select {
+	case <-stopAfterBatch:
+		halt("signal")
+		return false
+	case <-haltDispatch:
+		return false
+	case <-time.After(pause):
+		return true
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitBatches(t *testing.T) {
+	users := make([]userJob, 7)
+	tests := []struct {
+		size int
+		want []int
+	}{
+		{0, []int{7}},
+		{10, []int{7}},
+		{7, []int{7}},
+		{3, []int{3, 3, 1}},
+		{1, []int{1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		batches := splitBatches(users, tt.size)
+		if len(batches) != len(tt.want) {
+			t.Fatalf("size=%d got %d batches, wanted %d", tt.size, len(batches), len(tt.want))
+		}
+		for i := range batches {
+			if len(batches[i]) != tt.want[i] {
+				t.Errorf("size=%d batch %d got %d users, wanted %d", tt.size, i, len(batches[i]), tt.want[i])
+			}
+		}
+	}
+}
+
+func TestWaitForNextBatch(t *testing.T) {
+	defer func() {
+		stopAfterBatch, haltDispatch, haltOnce, haltReason = make(chan struct{}), make(chan struct{}), sync.Once{}, ""
+	}()
+
+	if !waitForNextBatch(time.Millisecond) {
+		t.Errorf("expected the next batch to run")
+	}
+
+	// The first SIGINT of a batched run stops it between batches, as a halt by signal.
+	close(stopAfterBatch)
+	if waitForNextBatch(time.Hour) {
+		t.Errorf("expected the run to stop after the batch")
+	}
+	if !halted() || haltReason != "signal" {
+		t.Errorf("halted=%t reason=%s, wanted a halt by signal", halted(), haltReason)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// userJob is a single user queued for deletion. The created timestamp is zero when the user came
+// from a file, otherwise the worker checks it has not changed before deleting the user.
+type userJob struct {
+	ID               string `json:"id"`
+	Username         string `json:"username"`
+	CreatedTimestamp int64  `json:"createdTimestamp,omitempty"`
+	// The retention policy that selected the user, when deleting by `policyFile`.
+	Policy string `json:"policy,omitempty"`
+	// Where the user's cutoff came from, when it is read from keycloak.
+	CutoffSource string `json:"cutoffSource,omitempty"`
+}
+
+// findCandidates searches the `searchMin`/`searchMax` window, a page of `scanPageSize` users at a
+// time, for the users created on or before the cutoff. The users are returned oldest first, along
+// with the number of users searched.
+func findCandidates(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, deleteEpochTime int64) ([]userJob, int, error) {
+	return scanCandidates(ctx, client, accessToken, targetRealm, createdBefore(deleteEpochTime), *searchMin, nil)
+}
+
+// A userSelector returns the job for a user that should be deleted.
+type userSelector func(user *gocloak.User) (userJob, bool)
+
+// createdBefore selects the users created on or before the cutoff.
+func createdBefore(deleteEpochTime int64) userSelector {
+	return func(user *gocloak.User) (userJob, bool) {
+		if user.CreatedTimestamp != nil && deleteEpochTime >= *user.CreatedTimestamp {
+			return userJob{ID: *user.ID, Username: *user.Username, CreatedTimestamp: *user.CreatedTimestamp}, true
+		}
+		return userJob{}, false
+	}
+}
+
+// scanCandidates continues a search from position, adding the selected users to those already
+// found. The checkpoint is updated after each page.
+func scanCandidates(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, selected userSelector, position int, found []userJob) ([]userJob, int, error) {
+	pageSize := *scanPageSize
+	if pageSize <= 0 {
+		pageSize = *searchMax
+	}
+	end := *searchMin + *searchMax
+
+	candidates := found
+	searched := 0
+	for first := position; first < end; {
+		max := pageSize
+		if first+max > end {
+			max = end - first
+		}
+		userParams := gocloak.GetUsersParams{}
+		userParams.First = gocloak.IntP(first)
+		userParams.Max = gocloak.IntP(max)
+		users, err := client.GetUsers(ctx, accessToken, targetRealm, userParams)
+		if err != nil {
+			return nil, searched, err
+		}
+		searched += len(users)
+		for _, user := range users {
+			if job, ok := selected(user); ok {
+				candidates = append(candidates, job)
+			}
+		}
+		if len(users) < max {
+			break
+		}
+		first += len(users)
+		checkpoint.scanned(first, candidates, false)
+	}
+
+	sortOldestFirst(candidates)
+	return candidates, searched, nil
+}
+
+// sortOldestFirst orders the users by created timestamp, oldest first. Users without a timestamp
+// go last, in their original order, so a `limit` takes the oldest known users first.
+func sortOldestFirst(users []userJob) {
+	sort.SliceStable(users, func(i, j int) bool {
+		a, b := users[i].CreatedTimestamp, users[j].CreatedTimestamp
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+}
+
+// limitCandidates keeps at most limit users, returning the rest as the backlog for a later run.
+func limitCandidates(users []userJob, limit int) ([]userJob, []userJob) {
+	if limit <= 0 || len(users) <= limit {
+		return users, nil
+	}
+	return users[:limit], users[limit:]
+}
+
+// feedJobs dispatches users that have already been selected to the workers, until every user has
+// been dispatched, the dispatch is halted, or every worker has exited (e.g. unable to log in). The
+// users not dispatched are returned.
+func feedJobs(users []userJob, jobs chan userJob, workersDone <-chan struct{}) []userJob {
+	defer close(jobs)
+	for i, user := range users {
+		if halted() {
+			atomic.AddInt32(&processed, int32(i))
+			return users[i:]
+		}
+		select {
+		case jobs <- user:
+		case <-haltDispatch:
+			atomic.AddInt32(&processed, int32(i))
+			return users[i:]
+		case <-workersDone:
+			atomic.AddInt32(&processed, int32(i))
+			return users[i:]
+		}
+	}
+	atomic.AddInt32(&processed, int32(len(users)))
+	return nil
+}
+
+// countUsers returns the total number of users in the realm.
+func countUsers(realmName string, clientId string, clientSecret string, targetRealm string, url string) (int, error) {
+	validate := false
+	client, token, err := login(realmName, clientId, clientSecret, url, *headerKey, *headerValue, loginAsAdmin, &validate)
+	if err != nil {
+		return 0, err
+	}
+	return client.GetUserCount(context.Background(), token.AccessToken, targetRealm, gocloak.GetUsersParams{})
+}
+
+// checkDeletionLimits guards against deleting far more users than intended, such as a typo'd
+// `--days 0`. A limit of zero is disabled.
+func checkDeletionLimits(count int, totalUsers int, maxCount int, maxPercent float64) error {
+	if maxCount > 0 && count > maxCount {
+		return fmt.Errorf("%d users would be deleted, more than maxDeletes=%d", count, maxCount)
+	}
+	if maxPercent > 0 {
+		if totalUsers <= 0 {
+			if count > 0 {
+				return fmt.Errorf("%d users would be deleted, and the realm's total is unknown for maxDeletePercent=%g", count, maxPercent)
+			}
+			return nil
+		}
+		percent := float64(count) * 100 / float64(totalUsers)
+		if percent > maxPercent {
+			return fmt.Errorf("%d of %d users (%.1f%%) would be deleted, more than maxDeletePercent=%g", count, totalUsers, percent, maxPercent)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestCheckDeletionLimits(t *testing.T) {
+	tests := []struct {
+		count      int
+		total      int
+		maxCount   int
+		maxPercent float64
+		wantErr    bool
+	}{
+		{100, 1000, 0, 0, false},
+		{100, 1000, 100, 0, false},
+		{101, 1000, 100, 0, true},
+		{100, 1000, 0, 10, false},
+		{101, 1000, 0, 10, true},
+		{1000, 1000, 5000, 50, true},
+		{1, 0, 0, 10, true},
+		{0, 0, 0, 10, false},
+	}
+	for _, tt := range tests {
+		err := checkDeletionLimits(tt.count, tt.total, tt.maxCount, tt.maxPercent)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("count=%d total=%d maxDeletes=%d maxDeletePercent=%g got err=%v", tt.count, tt.total, tt.maxCount, tt.maxPercent, err)
+		}
+	}
+}
+
+func TestSortAndLimitCandidates(t *testing.T) {
+	users := []userJob{
+		{Username: "c", CreatedTimestamp: 300},
+		{Username: "a", CreatedTimestamp: 100},
+		{Username: "b", CreatedTimestamp: 200},
+	}
+	sortOldestFirst(users)
+	if users[0].Username != "a" || users[1].Username != "b" || users[2].Username != "c" {
+		t.Errorf("got %v, wanted oldest first", users)
+	}
+
+	// Users without a timestamp go last, keeping their order.
+	unknown := []userJob{
+		{Username: "x"},
+		{Username: "b", CreatedTimestamp: 200},
+		{Username: "y"},
+		{Username: "a", CreatedTimestamp: 100},
+	}
+	sortOldestFirst(unknown)
+	if unknown[0].Username != "a" || unknown[1].Username != "b" || unknown[2].Username != "x" || unknown[3].Username != "y" {
+		t.Errorf("got %v, wanted the users without a timestamp last", unknown)
+	}
+
+	selected, backlog := limitCandidates(users, 2)
+	if len(selected) != 2 || len(backlog) != 1 || backlog[0].Username != "c" {
+		t.Errorf("got selected=%v backlog=%v", selected, backlog)
+	}
+	selected, backlog = limitCandidates(users, 0)
+	if len(selected) != 3 || backlog != nil {
+		t.Errorf("got selected=%v backlog=%v, wanted no limit", selected, backlog)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// checkpoint is the running deletion's checkpoint, nil when nothing is being deleted.
+var checkpoint *checkpointWriter
+
+// checkpointCriteria are the flags that choose which users are deleted. A run can only be resumed
+// with the same criteria. `days` is hashed rather than the cutoff, so a run can be resumed the next
+// day, and the resumed run keeps the original cutoff. The contents of the files are hashed as well
+// as their paths, so an edited file is not taken for the original.
+type checkpointCriteria struct {
+	URL                   string `json:"url"`
+	Realm                 string `json:"realm"`
+	Days                  int    `json:"days"`
+	DeleteDate            string `json:"deleteDate"`
+	SearchMin             int    `json:"searchMin"`
+	SearchMax             int    `json:"searchMax"`
+	Limit                 int    `json:"limit,omitempty"`
+	FromFile              string `json:"fromFile"`
+	FromFileHash          string `json:"fromFileHash,omitempty"`
+	Apply                 string `json:"apply"`
+	PolicyFile            string `json:"policyFile,omitempty"`
+	PolicyFileHash        string `json:"policyFileHash,omitempty"`
+	RetentionFromKeycloak bool   `json:"retentionFromKeycloak,omitempty"`
+	MinRetentionDays      int    `json:"minRetentionDays"`
+	RequireNotification   bool   `json:"requireNotification"`
+	NotifyDays            int    `json:"notifyDays"`
+	NotifyAttribute       string `json:"notifyAttribute"`
+}
+
+func criteriaHash() string {
+	data, err := json.Marshal(checkpointCriteria{
+		URL:                   *url,
+		Realm:                 *destinationRealm,
+		Days:                  *maxAgeInDays,
+		DeleteDate:            *deleteDate,
+		SearchMin:             *searchMin,
+		SearchMax:             *searchMax,
+		Limit:                 *limit,
+		FromFile:              *fromFile,
+		FromFileHash:          fileHash(*fromFile),
+		Apply:                 *applyFile,
+		PolicyFile:            *policyFile,
+		PolicyFileHash:        fileHash(*policyFile),
+		RetentionFromKeycloak: *retentionFromKeycloak,
+		MinRetentionDays:      *minRetentionDays,
+		RequireNotification:   *requireNotification,
+		NotifyDays:            *notifyDays,
+		NotifyAttribute:       *notifyAttribute,
+	})
+	if err != nil {
+		// Only plain values are marshalled, so this can't happen.
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fileHash returns the sha256 of the file, or nothing for no file or stdin. A file that can't be
+// read fails the run when it is used, so it hashes to nothing here.
+func fileHash(path string) string {
+	if path == "" || path == "-" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// selectionMode names how the users are chosen, recorded with the checkpoint.
+func selectionMode() string {
+	switch {
+	case *applyFile != "":
+		return "apply"
+	case *fromFile != "":
+		return "fromFile"
+	case *policyFile != "":
+		return "policyFile"
+	case *retentionFromKeycloak:
+		return "retentionFromKeycloak"
+	}
+	return "cutoff"
+}
+
+// hasSelectionCriteria returns true when the command line chooses the users, rather than leaving it
+// to the run being resumed.
+func hasSelectionCriteria() bool {
+	return hasDeletionCriteria() || *fromFile != "" || *applyFile != "" || *policyFile != "" || *retentionFromKeycloak
+}
+
+// key identifies the user in the checkpoint. Users from a file may only have a username.
+func (j userJob) key() string {
+	if j.ID != "" {
+		return j.ID
+	}
+	return "username:" + j.Username
+}
+
+// checkpointWriter keeps the checkpoint up to date as the users are found and processed, so a
+// crashed run can be resumed without searching again or reprocessing users. It is shared by all the
+// workers. Each outcome is appended to a journal beside the resume file, rather than rewriting the
+// resume file, and the journal is compacted into the resume file on exit.
+type checkpointWriter struct {
+	mu      sync.Mutex
+	state   *resumeState
+	every   int
+	pending int
+	path    string
+	journal *os.File
+}
+
+// journalEntry is a line of the journal.
+type journalEntry struct {
+	Key     string `json:"key"`
+	Outcome string `json:"outcome"`
+}
+
+// journalPath returns the journal for a resume file.
+func journalPath(resumeFile string) string {
+	return strings.TrimSuffix(resumeFile, ".resume.json") + ".journal.ndjson"
+}
+
+// startCheckpoint writes the initial checkpoint, and starts its journal, synced to disk after every
+// `every` users.
+func startCheckpoint(state *resumeState, every int) (*checkpointWriter, error) {
+	if state.Processed == nil {
+		state.Processed = map[string]string{}
+	}
+	c := &checkpointWriter{state: state, every: every}
+	if err := c.saveLocked(); err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(journalPath(c.path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c.journal = journal
+	return c, nil
+}
+
+// scanned records the users found so far, and where the next search starts.
+func (c *checkpointWriter) scanned(position int, users []userJob, done bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.ScanPosition = position
+	c.state.Scanning = !done
+	c.state.Users = users
+	c.saveLocked()
+}
+
+// record stores the outcome of processing the user.
+func (c *checkpointWriter) record(job userJob, outcome string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Processed[job.key()] = outcome
+	line, err := json.Marshal(journalEntry{Key: job.key(), Outcome: outcome})
+	if err == nil && len(outputRecipients) > 0 {
+		line, err = encryptLine(line, outputRecipients)
+	}
+	if err == nil {
+		_, err = c.journal.Write(append(line, '\n'))
+	}
+	c.pending++
+	if err == nil && c.pending >= c.every {
+		c.pending = 0
+		err = c.journal.Sync()
+	}
+	if err != nil {
+		output(WARNING, true, true, "[M]       : unable to write checkpoint journal err=%s", err)
+	}
+}
+
+// save compacts the journal into the checkpoint, such as before an exit.
+func (c *checkpointWriter) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saveLocked()
+}
+
+// saveLocked writes the whole checkpoint, after which the journal is no longer needed.
+func (c *checkpointWriter) saveLocked() error {
+	c.pending = 0
+	path, err := writeResumeState(c.state)
+	if err != nil {
+		output(WARNING, true, true, "[M]       : unable to write checkpoint err=%s", err)
+		return err
+	}
+	c.path = path
+	if c.journal != nil {
+		if err := c.journal.Truncate(0); err != nil {
+			output(WARNING, true, true, "[M]       : unable to compact checkpoint journal err=%s", err)
+		}
+	}
+	return nil
+}
+
+// snapshot copies the checkpoint state, so it can be written with a new reason and users.
+func (c *checkpointWriter) snapshot() resumeState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := *c.state
+	state.Processed = make(map[string]string, len(c.state.Processed))
+	for key, outcome := range c.state.Processed {
+		state.Processed[key] = outcome
+	}
+	return state
+}
+
+// replayJournal adds the outcomes in the journal to the state, decrypting the encrypted lines with
+// the identities. A crash can leave the last line half written, so it is ignored.
+func replayJournal(state *resumeState, resumeFile string, identities []age.Identity) error {
+	file, err := os.Open(journalPath(resumeFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if isEncryptedLine(line) {
+			if line, err = decryptLine(line, identities); err != nil {
+				continue
+			}
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Key == "" {
+			continue
+		}
+		if state.Processed == nil {
+			state.Processed = map[string]string{}
+		}
+		state.Processed[entry.Key] = entry.Outcome
+	}
+	return scanner.Err()
+}
+
+// recordOutcome records the outcome of processing the user in the checkpoint, and its policy's
+// counters.
+func recordOutcome(job userJob, outcome string) {
+	checkpoint.record(job, outcome)
+	countPolicyOutcome(job, outcome)
+}
+
+// stopCheckpoint removes the checkpoint, once every user has been processed or nothing will be
+// deleted.
+func stopCheckpoint() {
+	if checkpoint == nil {
+		return
+	}
+	checkpoint.journal.Close()
+	removeResumeState(checkpoint.state.RunID)
+	checkpoint = nil
+}
+
+// checkCriteria refuses to resume a run with different selection criteria, when they are given. A
+// run stopped while still searching is only resumed with the same criteria, as the policies and
+// limits have not been applied to the users found so far, and the rest are found with the original
+// selection.
+func (r *resumeState) checkCriteria(hash string, given bool) error {
+	if r.Scanning && r.CriteriaHash == "" {
+		return fmt.Errorf("runId=%s was stopped while searching, before its criteria were recorded, start a new run", r.RunID)
+	}
+	if !given && !r.Scanning {
+		return nil
+	}
+	if r.CriteriaHash != "" && r.CriteriaHash != hash {
+		if !given {
+			return fmt.Errorf("runId=%s was stopped while searching by selection=%s, resume with the same criteria", r.RunID, r.Selection)
+		}
+		return fmt.Errorf("the criteria have changed since runId=%s, resume with the same days, deleteDate, searchMin, searchMax, limit, fromFile, apply, policyFile, retentionFromKeycloak, minRetentionDays, requireNotification, notifyDays and notifyAttribute, and unchanged files", r.RunID)
+	}
+	return nil
+}
+
+// pending returns the users still to be processed. Users that failed are tried again.
+func (r *resumeState) pending() []userJob {
+	var users []userJob
+	for _, user := range r.Users {
+		if outcome, ok := r.Processed[user.key()]; ok && outcome != OUTCOME_FAILED {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointRecordsOutcomes(t *testing.T) {
+	saved := *logDir
+	*logDir = t.TempDir()
+	defer func() { *logDir = saved }()
+
+	users := []userJob{{ID: "a1", Username: "userA"}, {ID: "b2", Username: "userB"}, {Username: "userC"}, {ID: "d4", Username: "userD"}}
+	c, err := startCheckpoint(&resumeState{RunID: "1700000000", Scanning: true}, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.scanned(100, users, true)
+	c.record(users[0], OUTCOME_DELETED)
+	c.record(users[1], OUTCOME_FAILED)
+	c.record(users[2], OUTCOME_SKIPPED)
+
+	// The outcomes are only in the journal, which is replayed when the run is resumed.
+	data, err := os.ReadFile(resumePath("1700000000"))
+	if err != nil || strings.Contains(string(data), "a1\": \"deleted") {
+		t.Errorf("expected the outcomes in the journal only, err=%v", err)
+	}
+	got, err := readResumeState("1700000000")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.Scanning || got.ScanPosition != 100 || len(got.Users) != 4 || len(got.Processed) != 3 {
+		t.Errorf("got %+v", got)
+	}
+
+	if err := c.save(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got, err = readResumeState("1700000000")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.Processed["username:userC"] != OUTCOME_SKIPPED {
+		t.Errorf("processed=%v", got.Processed)
+	}
+	// Saving compacts the journal into the checkpoint.
+	if info, err := os.Stat(journalPath(c.path)); err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty journal after saving, err=%v", err)
+	}
+
+	// The failed user is tried again, along with the user never processed.
+	pending := got.pending()
+	if len(pending) != 2 || pending[0].ID != "b2" || pending[1].ID != "d4" {
+		t.Errorf("pending=%v", pending)
+	}
+}
+
+func TestCheckpointCriteria(t *testing.T) {
+	saved := *maxAgeInDays
+	defer func() { *maxAgeInDays = saved }()
+
+	*maxAgeInDays = 30
+	state := &resumeState{RunID: "1700000000", CriteriaHash: criteriaHash()}
+	if err := state.checkCriteria(criteriaHash(), true); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	*maxAgeInDays = 3
+	if err := state.checkCriteria(criteriaHash(), true); err == nil {
+		t.Errorf("expected an error when the criteria have changed")
+	}
+	// The users have all been found, so they can be resumed without the criteria.
+	if err := state.checkCriteria(criteriaHash(), false); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// A run stopped while searching needs the same criteria to find the rest.
+	state.Scanning = true
+	if err := state.checkCriteria(criteriaHash(), false); err == nil {
+		t.Errorf("expected an error resuming a search without its criteria")
+	}
+	*maxAgeInDays = 30
+	if err := state.checkCriteria(criteriaHash(), true); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Resume files written before the criteria were recorded can still be resumed, but not a search.
+	state.CriteriaHash = ""
+	if err := state.checkCriteria(criteriaHash(), true); err == nil {
+		t.Errorf("expected an error resuming a search without recorded criteria")
+	}
+	state.Scanning = false
+	if err := state.checkCriteria(criteriaHash(), true); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCriteriaHashIncludesFiles(t *testing.T) {
+	saved, savedMin := *policyFile, *minRetentionDays
+	defer func() { *policyFile, *minRetentionDays = saved, savedMin }()
+
+	*policyFile = t.TempDir() + "/policies.yaml"
+	os.WriteFile(*policyFile, []byte("policies: []\n"), 0600)
+	state := &resumeState{RunID: "1700000000", CriteriaHash: criteriaHash()}
+
+	// The same path, edited between the crash and the resume.
+	os.WriteFile(*policyFile, []byte("policies: [{name: everyone}]\n"), 0600)
+	if err := state.checkCriteria(criteriaHash(), true); err == nil {
+		t.Errorf("expected an error when the policy file has changed")
+	}
+	os.WriteFile(*policyFile, []byte("policies: []\n"), 0600)
+	*minRetentionDays = 1
+	if err := state.checkCriteria(criteriaHash(), true); err == nil {
+		t.Errorf("expected an error when minRetentionDays has changed")
+	}
+}
+
+func TestReplayJournalIgnoresHalfWrittenLine(t *testing.T) {
+	path := t.TempDir() + "/1700000000.resume.json"
+	journal := `{"key":"a1","outcome":"deleted"}` + "\n" + `{"key":"b2","outcome":"fai`
+	if err := os.WriteFile(journalPath(path), []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state := &resumeState{}
+	if err := replayJournal(state, path, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(state.Processed) != 1 || state.Processed["a1"] != OUTCOME_DELETED {
+		t.Errorf("processed=%v", state.Processed)
+	}
+}
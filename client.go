@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// clientTLS is the TLS configuration for keycloak, nil to use the system defaults.
+var clientTLS *tls.Config
+
+// loadTLSConfig builds the TLS configuration from the `tlsCaFile`, `tlsCertFile`, `tlsKeyFile` and
+// `tlsInsecureSkipVerify` options, returning nil when none are set.
+func loadTLSConfig(caFile string, certFile string, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s has no PEM certificates", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newClient creates the keycloak client, with the legacy url, custom headers and TLS settings.
+func newClient(url string, headerName string, headerValue string) *gocloak.GoCloak {
+	var client *gocloak.GoCloak
+	if *useLegacyKeycloak {
+		// This is for older versions of Keycloak that is based on WildFly
+		client = gocloak.NewClient(url, gocloak.SetLegacyWildFlySupport())
+	} else {
+		// This is for newer versions of Keycloak, that is based on quarkus
+		client = gocloak.NewClient(url)
+	}
+	// Add the custom header set, if configured.
+	if strings.TrimSpace(headerName) != "" && strings.TrimSpace(headerValue) != "" {
+		client.RestyClient().Header.Set(headerName, headerValue)
+	}
+	for name, value := range *headers {
+		client.RestyClient().Header.Set(name, value)
+	}
+	if clientTLS != nil {
+		client.RestyClient().SetTLSClientConfig(clientTLS)
+	}
+	return client
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configAliases maps the keys used by `connection.properties` to the flags they set.
+var configAliases = map[string]string{
+	"keycloakURL": "url",
+	"adminRealm":  "clientRealm",
+	"targetRealm": "destinationRealm",
+}
+
+// configValues and profileValues hold the values set by the config file and the selected profile,
+// by flag name.
+var configValues = map[string]string{}
+var profileValues = map[string]string{}
+
+// productionProfile is set when the selected profile is tagged `production`.
+var productionProfile bool
+
+// findArg finds a flag before the command line is parsed, as the config file and profile have to
+// be applied first for the command line to override them. The environment variable is used when
+// the flag is not given.
+func findArg(args []string, name string, env string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if value, ok := strings.CutPrefix(arg, "--"+name+"="); ok {
+			return value
+		}
+		if arg == "--"+name && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv(env)
+}
+
+// loadConfig applies the config file, then the profile selected from it.
+func loadConfig(flags *flag.FlagSet, path string, profile string) error {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	base, selected, production, err := selectProfile(values, profile)
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(flags, base, configValues); err != nil {
+		return err
+	}
+	if err := applyConfig(flags, selected, profileValues); err != nil {
+		return err
+	}
+	productionProfile = production
+	return nil
+}
+
+// readConfigFile reads a YAML file (`.yaml` or `.yml`), or otherwise a java style properties file,
+// into flag values.
+func readConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseYAMLConfig(file)
+	default:
+		return parseProperties(file)
+	}
+}
+
+// parseProperties parses `key=value` or `key: value` lines, ignoring `#` and `!` comments.
+func parseProperties(in io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(in)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == '!' {
+			continue
+		}
+		i := strings.IndexAny(text, "=:")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected `key=value`", line)
+		}
+		values[strings.TrimSpace(text[:i])] = strings.TrimSpace(text[i+1:])
+	}
+	return values, scanner.Err()
+}
+
+// parseYAMLConfig parses a YAML map of flag names to values. Lists are joined with commas, as the
+// flags that take several values do, and nested maps are flattened to dotted keys, as they would be
+// written in a properties file.
+func parseYAMLConfig(in io.Reader) (map[string]string, error) {
+	var doc map[string]interface{}
+	if err := yaml.NewDecoder(in).Decode(&doc); err != nil && err != io.EOF {
+		return nil, err
+	}
+	values := map[string]string{}
+	flattenYAML("", doc, values)
+	return values, nil
+}
+
+func flattenYAML(prefix string, doc map[string]interface{}, values map[string]string) {
+	for key, value := range doc {
+		switch v := value.(type) {
+		case nil:
+			values[prefix+key] = ""
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[prefix+key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			flattenYAML(prefix+key+".", v, values)
+		default:
+			values[prefix+key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// profileOptions are the options a profile can set, those that describe the keycloak server.
+var profileOptions = map[string]bool{
+	"url": true, "clientRealm": true, "clientId": true, "clientSecret": true, "loginAsAdmin": true,
+	"username": true, "password": true, "clientKeyFile": true, "clientKeyId": true, "clientAssertionAudience": true,
+	"destinationRealm": true, "useLegacyKeycloak": true, "headerKey": true, "headerValue": true, "headers": true,
+	"tlsCaFile": true, "tlsCertFile": true, "tlsKeyFile": true, "tlsInsecureSkipVerify": true,
+}
+
+// selectProfile splits the `profiles.<name>.` keys out of the config file values, returning the
+// rest of the file, the values of the named profile, and whether it is tagged `production`.
+func selectProfile(values map[string]string, name string) (map[string]string, map[string]string, bool, error) {
+	base := map[string]string{}
+	selected := map[string]string{}
+	found := false
+	production := false
+	for key, value := range values {
+		rest, ok := strings.CutPrefix(key, "profiles.")
+		if !ok {
+			base[key] = value
+			continue
+		}
+		option, ok := strings.CutPrefix(rest, name+".")
+		if name == "" || !ok {
+			continue
+		}
+		found = true
+		if option == "production" {
+			production = strings.EqualFold(value, "true")
+			continue
+		}
+		if !profileOptions[strings.SplitN(option, ".", 2)[0]] {
+			return nil, nil, false, fmt.Errorf("%s can not be set by a profile", option)
+		}
+		selected[option] = value
+	}
+	if name != "" && !found {
+		return nil, nil, false, fmt.Errorf("profile %s is not in the config file", name)
+	}
+	return base, selected, production, nil
+}
+
+// applyConfig sets the flags from the config file, recording them in sources. The flags are not
+// marked as changed, so the environment and command line still override them. The `headers.<name>`
+// keys are combined into the `headers` flag.
+func applyConfig(flags *flag.FlagSet, values map[string]string, sources map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var headers []string
+	for _, key := range keys {
+		if header, ok := strings.CutPrefix(key, "headers."); ok {
+			headers = append(headers, header+"="+values[key])
+			continue
+		}
+		name := key
+		if alias, ok := configAliases[key]; ok {
+			name = alias
+		}
+		if err := setConfigValue(flags, name, values[key], sources); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if len(headers) > 0 {
+		return setConfigValue(flags, "headers", strings.Join(headers, ","), sources)
+	}
+	return nil
+}
+
+func setConfigValue(flags *flag.FlagSet, name string, value string, sources map[string]string) error {
+	f := flags.Lookup(name)
+	if f == nil || name == "config" || name == "profile" {
+		return fmt.Errorf("%s is not an option", name)
+	}
+	if err := setFlagValue(f, value); err != nil {
+		return err
+	}
+	sources[name] = value
+	return nil
+}
+
+// setFlagValue sets the flag from a config file or environment variable. A list replaces the value,
+// rather than adding to it, as a profile overrides the rest of the file.
+func setFlagValue(f *flag.Flag, value string) error {
+	if list, ok := f.Value.(flag.SliceValue); ok {
+		return list.Replace(strings.Split(value, ","))
+	}
+	return f.Value.Set(value)
+}
+
+// valueSource returns where the flag's value came from, in order of precedence.
+func valueSource(name string) string {
+	if f := flag.Lookup(name); f != nil && f.Changed {
+		return "[flag]"
+	}
+	if env, ok := envSources[name]; ok {
+		return "[env " + env + "]"
+	}
+	if _, ok := profileValues[name]; ok {
+		return "[profile " + *profileName + "]"
+	}
+	if _, ok := configValues[name]; ok {
+		return "[file]"
+	}
+	return "[default]"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+func TestFindArg(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--days=30", "--config=prod.yaml"}, "prod.yaml"},
+		{[]string{"--config", "prod.properties", "--dryRun"}, "prod.properties"},
+		{[]string{"--days=30", "--", "--config=ignored.yaml"}, ""},
+		{[]string{"--days=30"}, ""},
+	}
+	for _, tt := range tests {
+		if got := findArg(tt.args, "config", ENV_CONFIG); got != tt.want {
+			t.Errorf("findArg(%v)=%q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestReadExampleProperties(t *testing.T) {
+	values, err := readConfigFile("connection.example.properties")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if values["keycloakURL"] != "http://localhost:8080" || values["adminRealm"] != "master" || values["targetRealm"] != "test" {
+		t.Errorf("values=%v", values)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	url := flags.String("url", URL, "")
+	clientRealm := flags.String("clientRealm", CLIENT_REALM, "")
+	destinationRealm := flags.String("destinationRealm", DESTINATION_REALM, "")
+	flags.String("clientId", CLIENT_ID, "")
+	flags.String("clientSecret", CLIENT_SECRET, "")
+	if err := applyConfig(flags, values, map[string]string{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if *url != "http://localhost:8080" || *clientRealm != "master" || *destinationRealm != "test" {
+		t.Errorf("url=%s clientRealm=%s destinationRealm=%s", *url, *clientRealm, *destinationRealm)
+	}
+
+	// The command line still overrides the file.
+	if err := flags.Parse([]string{"--destinationRealm=other"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if *destinationRealm != "other" {
+		t.Errorf("destinationRealm=%s, want the flag value", *destinationRealm)
+	}
+}
+
+func TestParseYAMLConfig(t *testing.T) {
+	values, err := parseYAMLConfig(strings.NewReader("days: 30\ndryRun: true\nencryptTo:\n  - age1abc\n  - age1def\nwindow: Mon-Fri 01:00-05:00 UTC\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := map[string]string{"days": "30", "dryRun": "true", "encryptTo": "age1abc,age1def", "window": "Mon-Fri 01:00-05:00 UTC"}
+	for key, value := range want {
+		if values[key] != value {
+			t.Errorf("%s=%q, want %q", key, values[key], value)
+		}
+	}
+
+	// Nested maps are flattened, as they would be written in a properties file.
+	values, err = parseYAMLConfig(strings.NewReader("headers:\n  X-Api-Key: abc\nprofiles:\n  prod-au:\n    url: https://au.example.com\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if values["headers.X-Api-Key"] != "abc" || values["profiles.prod-au.url"] != "https://au.example.com" {
+		t.Errorf("values=%v", values)
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	values := map[string]string{
+		"days":                          "365",
+		"url":                           URL,
+		"profiles.dev.url":              "http://127.0.0.1:8080",
+		"profiles.prod-au.url":          "https://au.example.com",
+		"profiles.prod-au.production":   "true",
+		"profiles.prod-au.headers.X-Az": "au",
+	}
+	base, selected, production, err := selectProfile(values, "prod-au")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(base) != 2 || base["days"] != "365" {
+		t.Errorf("base=%v", base)
+	}
+	if len(selected) != 2 || selected["url"] != "https://au.example.com" || selected["headers.X-Az"] != "au" || !production {
+		t.Errorf("selected=%v production=%t", selected, production)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	url := flags.String("url", URL, "")
+	headers := flags.StringToString("headers", map[string]string{}, "")
+	if err := applyConfig(flags, selected, map[string]string{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if *url != "https://au.example.com" || (*headers)["X-Az"] != "au" {
+		t.Errorf("url=%s headers=%v", *url, *headers)
+	}
+
+	if _, _, production, _ := selectProfile(values, "dev"); production {
+		t.Errorf("dev is not production")
+	}
+	if _, _, _, err := selectProfile(values, "prod-us"); err == nil {
+		t.Errorf("expected an error for a missing profile")
+	}
+	if _, _, _, err := selectProfile(map[string]string{"profiles.dev.days": "0"}, "dev"); err == nil {
+		t.Errorf("expected an error for an option a profile can not set")
+	}
+}
+
+func TestApplyConfigUnknownOption(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Int("days", EMPTY_DAYS, "")
+	if err := applyConfig(flags, map[string]string{"dayz": "30"}, map[string]string{}); err == nil {
+		t.Errorf("expected an error for an unknown option")
+	}
+	if err := applyConfig(flags, map[string]string{"days": "thirty"}, map[string]string{}); err == nil {
+		t.Errorf("expected an error for an invalid value")
+	}
+}
+
+func TestValueSource(t *testing.T) {
+	if got := valueSource("window"); got != "[default]" {
+		t.Errorf("valueSource=%s, want [default]", got)
+	}
+	configValues["window"] = "* 01:00-02:00"
+	defer delete(configValues, "window")
+	if got := valueSource("window"); got != "[file]" {
+		t.Errorf("valueSource=%s, want [file]", got)
+	}
+	envSources["window"] = ENV_WINDOW
+	defer delete(envSources, "window")
+	if got := valueSource("window"); got != "[env KC_WINDOW]" {
+		t.Errorf("valueSource=%s, want [env KC_WINDOW]", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// isInteractive returns true when stdin is a terminal, so the operator can be asked to confirm.
+func isInteractive() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmDeletion shows what is about to be deleted, and requires the operator to type the realm
+// name before anything is deleted.
+func confirmDeletion(in io.Reader, out io.Writer, url string, realm string, cutoff string, count int) bool {
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "  About to DELETE users:")
+	fmt.Fprintln(out, "    url:", url)
+	fmt.Fprintln(out, "    destinationRealm:", realm)
+	fmt.Fprintln(out, "    olderThan:", cutoff)
+	fmt.Fprintln(out, "    users:", count)
+	fmt.Fprintln(out, "")
+	fmt.Fprint(out, "  Type the realm name to confirm: ")
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	return strings.TrimSpace(answer) == realm
+}
+
+// confirmContinue asks the operator to type the realm name again, once the canary users have been
+// checked, before the remaining users are deleted.
+func confirmContinue(in io.Reader, out io.Writer, realm string, remaining int) bool {
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "  Canary deleted, check downstream applications before continuing.")
+	fmt.Fprintln(out, "    remaining users:", remaining)
+	fmt.Fprintln(out, "")
+	fmt.Fprint(out, "  Type the realm name to continue, anything else pauses with a resume token: ")
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	return strings.TrimSpace(answer) == realm
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConfirmDeletion(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   bool
+	}{
+		{"delete\n", true},
+		{"  delete  \n", true},
+		{"delete", true},
+		{"yes\n", false},
+		{"Delete\n", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		got := confirmDeletion(strings.NewReader(tt.answer), &out, "http://127.0.0.1:8080", "delete", "2022-01-01", 10)
+		if got != tt.want {
+			t.Errorf("answer=%q got %t, wanted %t", tt.answer, got, tt.want)
+		}
+		if !strings.Contains(out.String(), "users: 10") {
+			t.Errorf("summary missing the user count %q", out.String())
+		}
+	}
+}
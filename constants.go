@@ -15,9 +15,27 @@ const (
 	MAX_AGE_IN_DAYS   = 30
 	DRY_RUN           = true
 	EMPTY_DAYS        = -1
+	// Password grant login, through a public client
+	PASSWORD_CLIENT_ID = "admin-cli"
+	// private_key_jwt client authentication, RFC 7523
+	CLIENT_ASSERTION_TYPE = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// Pre-deletion notification
+	NOTIFY_DAYS         = 14
+	NOTIFY_ATTRIBUTE    = "kcDeleteNotified"
+	NOTIFY_VIA_KEYCLOAK = "keycloak"
+	NOTIFY_VIA_SMTP     = "smtp"
+	NOTIFY_VIA          = NOTIFY_VIA_KEYCLOAK
+	NOTIFY_SUBJECT      = "Your account is scheduled for deletion"
+	SMTP_PORT           = 587
+	// Run lock
+	LOCK_ATTRIBUTE = "kcDeleteOlderThanLock"
+	// Retention set in keycloak
+	RETENTION_DAYS_ATTRIBUTE   = "kcDeleteRetentionDays"
+	RETENTION_DATE_ATTRIBUTE   = "kcDeleteRetentionDate"
+	RETENTION_EXEMPT_ATTRIBUTE = "kcDeleteRetentionExempt"
 )
 
-// Environment variables
+// Environment variables. Every flag has one, see envName, these are the ones used by name.
 const (
 	ENV_CLIENT_ID           = "KC_CLIENT_ID"
 	ENV_CLIENT_REALM        = "KC_CLIENT_REALM"
@@ -25,6 +43,7 @@ const (
 	ENV_URL                 = "KC_URL"
 	ENV_DESTINATION_REALM   = "KC_DESTINATION_REALM"
 	ENV_DRY_RUN             = "KC_DRY_RUN"
+	ENV_YES                 = "KC_YES"
 	ENV_USERNAME            = "KC_USERNAME"
 	ENV_LOG_DIR             = "KC_LOG_DIR"
 	ENV_LOG_CMD_VALUES      = "KC_LOG_CMD_VALUES"
@@ -35,15 +54,25 @@ const (
 	// concurrency
 	ENV_THREADS        = "KC_THREADS"
 	ENV_CHANNEL_BUFFER = "KC_CHANNEL_BUFFER"
-	// Deletion on days.
+	// Deletion on days, deprecated for KC_DELETE_DATE and KC_DAYS.
 	ENV_MAX_AGE_IN_DATE = "KC_MAX_AGE_IN_DATE"
 	ENV_MAX_AGE_IN_DAYS = "KC_MAX_AGE_IN_DAYS"
-	// Pagination
+	// Pagination, deprecated for KC_SEARCH_MAX and KC_SEARCH_MIN.
 	ENV_PAGE_SIZE   = "KC_PAGE_SIZE"
 	ENV_PAGE_OFFSET = "KC_PAGE_OFFSET"
-	// Header
+	// Header, KC_HEADER_NAME is deprecated for KC_HEADER_KEY.
 	ENV_HEADER_NAME  = "KC_HEADER_NAME"
 	ENV_HEADER_VALUE = "KC_HEADER_VALUE"
+	// Notification
+	ENV_NOTIFY               = "KC_NOTIFY"
+	ENV_NOTIFY_DAYS          = "KC_NOTIFY_DAYS"
+	ENV_REQUIRE_NOTIFICATION = "KC_REQUIRE_NOTIFICATION"
+	ENV_SMTP_PASSWORD        = "KC_SMTP_PASSWORD"
+	// Maintenance window
+	ENV_WINDOW = "KC_WINDOW"
+	// Config file
+	ENV_CONFIG  = "KC_CONFIG"
+	ENV_PROFILE = "KC_PROFILE"
 )
 
 // Output colours.
@@ -58,6 +87,26 @@ const (
 	colorWhite  = "\033[37m"
 )
 
+// Exit codes.
+const (
+	EXIT_LIMIT_EXCEEDED = 3
+	EXIT_NOT_CONFIRMED  = 4
+	EXIT_PAUSED         = 5
+	EXIT_OUTSIDE_WINDOW = 6
+	EXIT_INTERRUPTED    = 7
+	EXIT_FORCED         = 8
+	EXIT_LOCKED         = 9
+)
+
+// The outcome of processing a user, as recorded in the checkpoint.
+const (
+	OUTCOME_DELETED   = "deleted"
+	OUTCOME_NOT_FOUND = "notFound"
+	OUTCOME_SKIPPED   = "skipped"
+	OUTCOME_FAILED    = "failed"
+	OUTCOME_DRY_RUN   = "dryRun"
+)
+
 // Misc other constants.
 const (
 	// Date format
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// The first line of every binary age file.
+const ageHeader = "age-encryption.org/v1"
+
+// outputRecipients are the `--encryptTo` recipients, when set the backup and list files are encrypted.
+var outputRecipients []age.Recipient
+
+// printUsers returns false when `--encryptTo` is set, as the users listed are then only written to
+// the encrypted files, and not to stdout or the log.
+func printUsers() bool {
+	return len(outputRecipients) == 0
+}
+
+// parseRecipients parses a comma separated list of age recipients (age1...) or recipient files.
+func parseRecipients(spec string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, "age1") {
+			recipient, err := age.ParseX25519Recipient(entry)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, recipient)
+			continue
+		}
+		file, err := os.Open(entry)
+		if err != nil {
+			return nil, err
+		}
+		fromFile, err := age.ParseRecipients(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry, err)
+		}
+		recipients = append(recipients, fromFile...)
+	}
+	return recipients, nil
+}
+
+// loadIdentities reads the age identities (AGE-SECRET-KEY-1...) used to decrypt.
+func loadIdentities(path string) ([]age.Identity, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return age.ParseIdentities(file)
+}
+
+func encryptBytes(data []byte, recipients []age.Recipient) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func decryptBytes(data []byte, identities []age.Identity) ([]byte, error) {
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("encrypted content, but no `identityFile` given")
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// encryptLine encrypts a single record, so that it can be written and synced on its own. The result
+// is base64 encoded, to keep the file one record per line.
+func encryptLine(line []byte, recipients []age.Recipient) ([]byte, error) {
+	encrypted, err := encryptBytes(line, recipients)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(encrypted)), nil
+}
+
+func decryptLine(line []byte, identities []age.Identity) ([]byte, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	return decryptBytes(encrypted, identities)
+}
+
+// isEncryptedLine returns true for lines written by encryptLine, rather than plain JSON.
+func isEncryptedLine(line []byte) bool {
+	trimmed := bytes.TrimSpace(line)
+	return len(trimmed) > 0 && trimmed[0] != '{'
+}
+
+// writeOutputFile writes a report or list file that only the owner can read, encrypting the whole
+// file when `--encryptTo` is set.
+func writeOutputFile(path string, data []byte) error {
+	if len(outputRecipients) > 0 {
+		encrypted, err := encryptBytes(data, outputRecipients)
+		if err != nil {
+			return err
+		}
+		data = encrypted
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// decryptToWriter decrypts a file written by this tool. Whole files (list and report files) are
+// decrypted in one go, and backup files are decrypted line by line.
+func decryptToWriter(path string, identities []age.Identity, out io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte(ageHeader)) {
+		plain, err := decryptBytes(data, identities)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(plain)
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Bytes()
+		if isEncryptedLine(text) {
+			plain, err := decryptLine(bytes.TrimSpace(text), identities)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			text = plain
+		}
+		if _, err := fmt.Fprintln(out, string(text)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
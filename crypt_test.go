@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestDecryptToWriter(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	recipients, err := parseRecipients(identity.Recipient().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	identities := []age.Identity{identity}
+	dir := t.TempDir()
+
+	// A whole file, as written for the list file.
+	outputRecipients = recipients
+	defer func() { outputRecipients = nil }()
+	listPath := filepath.Join(dir, "list.csv")
+	if err := writeOutputFile(listPath, []byte("Username,ID\nuserA,a1\n")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	raw, _ := os.ReadFile(listPath)
+	if bytes.Contains(raw, []byte("userA")) {
+		t.Errorf("list file is not encrypted")
+	}
+	var out bytes.Buffer
+	if err := decryptToWriter(listPath, identities, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out.String() != "Username,ID\nuserA,a1\n" {
+		t.Errorf("got %q", out.String())
+	}
+
+	// Line by line, as written for the backup file.
+	line, err := encryptLine([]byte(`{"runId":"1"}`), recipients)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	backupPath := filepath.Join(dir, "backup.ndjson.enc")
+	os.WriteFile(backupPath, append(line, '\n'), 0600)
+	out.Reset()
+	if err := decryptToWriter(backupPath, identities, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.TrimSpace(out.String()) != `{"runId":"1"}` {
+		t.Errorf("got %q", out.String())
+	}
+
+	if err := decryptToWriter(backupPath, nil, &out); err == nil {
+		t.Errorf("expected an error without identities")
+	}
+}
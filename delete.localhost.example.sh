@@ -9,7 +9,11 @@ export KC_URL="http://127.0.0.1:8080"
 export KC_DESTINATION_REALM="delete"
 
 export KC_DRY_RUN="false"
-export KC_USERNAME="admin"
+## Without a terminal to confirm on, deletion also needs KC_YES, otherwise it is a dry run.
+#export KC_YES="true"
+## Login as a named user with the password grant, rather than as a client.
+#export KC_USERNAME="admin"
+#export KC_PASSWORD="file:///run/secrets/kc-password"
 export KC_LOG_DIR="/tmp"
 #export KC_LOG_CMD_VALUES=
 export KC_USE_LEGACY_KEYCLOAK="true"
@@ -18,15 +22,15 @@ export KC_LOGIN_AS_ADMIN="true"
 export KC_THREADS=2
 export KC_CHANNEL_BUFFER=10
 ## Deletion Date settings
-#export KC_MAX_AGE_IN_DATE="2020-01-01"
+#export KC_DELETE_DATE="2020-01-01"
 ## OR, but not both.
-export KC_MAX_AGE_IN_DAYS=30
+export KC_DAYS=30
 ## Header
-export KC_HEADER_NAME="X-Delete-Older-Than"
+export KC_HEADER_KEY="X-Delete-Older-Than"
 export KC_HEADER_VALUE="true"
 
 ##  PAgination
-export KC_PAGE_SIZE=5000
-export KC_PAGE_OFFSET=0
+export KC_SEARCH_MAX=5000
+export KC_SEARCH_MIN=0
 
 ./kc_delete_older_than "$@"
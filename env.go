@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	flag "github.com/spf13/pflag"
+)
+
+// legacyEnvVariables are the environment variables from before every flag had its own, by the
+// flag they set. They still work, with a warning, when the new variable is not set.
+var legacyEnvVariables = map[string]string{
+	ENV_MAX_AGE_IN_DATE: "deleteDate",
+	ENV_MAX_AGE_IN_DAYS: "days",
+	ENV_PAGE_SIZE:       "searchMax",
+	ENV_PAGE_OFFSET:     "searchMin",
+	ENV_HEADER_NAME:     "headerKey",
+	ENV_COUNT_ONLY:      "countTotalUsersOnly",
+}
+
+// envSources holds the environment variable that set each flag, by flag name.
+var envSources = map[string]string{}
+
+// envName returns the environment variable for a flag: `KC_`, then the flag name with each word
+// upper cased and separated by `_`, e.g. `destinationRealm` is `KC_DESTINATION_REALM`.
+func envName(flagName string) string {
+	var name strings.Builder
+	name.WriteString("KC_")
+	runes := []rune(flagName)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(runes[i-1]) {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// legacyEnvName returns the legacy environment variable for a flag, if it has one.
+func legacyEnvName(flagName string) string {
+	for env, name := range legacyEnvVariables {
+		if name == flagName {
+			return env
+		}
+	}
+	return ""
+}
+
+// bindEnv sets the flags from their environment variables, recording the variable used in sources.
+// Like the config file, the flags are not marked as changed, so the command line still overrides
+// them. It returns a warning for each legacy variable that is set.
+func bindEnv(flags *flag.FlagSet, sources map[string]string) ([]string, error) {
+	var warnings []string
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		env := envName(f.Name)
+		value := os.Getenv(env)
+		if legacy := legacyEnvName(f.Name); legacy != "" && os.Getenv(legacy) != "" {
+			if value != "" {
+				warnings = append(warnings, fmt.Sprintf("%s is deprecated and ignored, as %s is set", legacy, env))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("%s is deprecated, use %s", legacy, env))
+				env = legacy
+				value = os.Getenv(legacy)
+			}
+		}
+		if value == "" {
+			return
+		}
+		if setErr := setFlagValue(f, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", env, setErr)
+			return
+		}
+		sources[f.Name] = env
+	})
+	return warnings, err
+}
+
+// printEnv prints the environment variable for every flag, and where its value came from.
+func printEnv(out io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintf(out, "%-36s %-26s %s\n", "Variable", "Flag", "Source")
+	flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(out, "%-36s --%-24s %s\n", envName(f.Name), f.Name, valueSource(f.Name))
+	})
+
+	legacy := make([]string, 0, len(legacyEnvVariables))
+	for env := range legacyEnvVariables {
+		legacy = append(legacy, env)
+	}
+	sort.Strings(legacy)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Deprecated")
+	for _, env := range legacy {
+		name := legacyEnvVariables[env]
+		fmt.Fprintf(out, "%-36s --%-24s use %s\n", env, name, envName(name))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"url":                   "KC_URL",
+		"days":                  "KC_DAYS",
+		"destinationRealm":      "KC_DESTINATION_REALM",
+		"countTotalUsersOnly":   "KC_COUNT_TOTAL_USERS_ONLY",
+		"tlsInsecureSkipVerify": "KC_TLS_INSECURE_SKIP_VERIFY",
+		"restoreRunId":          "KC_RESTORE_RUN_ID",
+	}
+	for name, want := range tests {
+		if got := envName(name); got != want {
+			t.Errorf("envName(%s)=%s, want %s", name, got, want)
+		}
+	}
+}
+
+func testEnvFlags() (*flag.FlagSet, *int, *[]string) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	searchMax := flags.Int("searchMax", 100, "")
+	actions := flags.StringSlice("notifyActions", []string{"VERIFY_EMAIL"}, "")
+	flags.Bool("dryRun", false, "")
+	return flags, searchMax, actions
+}
+
+func TestBindEnv(t *testing.T) {
+	flags, searchMax, actions := testEnvFlags()
+	t.Setenv("KC_SEARCH_MAX", "500")
+	t.Setenv("KC_NOTIFY_ACTIONS", "UPDATE_PASSWORD,UPDATE_PROFILE")
+	sources := map[string]string{}
+	warnings, err := bindEnv(flags, sources)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("warnings=%v err=%v", warnings, err)
+	}
+	if *searchMax != 500 || sources["searchMax"] != "KC_SEARCH_MAX" {
+		t.Errorf("searchMax=%d sources=%v", *searchMax, sources)
+	}
+	if len(*actions) != 2 || (*actions)[0] != "UPDATE_PASSWORD" {
+		t.Errorf("notifyActions=%v, wanted the default replaced", *actions)
+	}
+	if _, ok := sources["dryRun"]; ok || flags.Lookup("searchMax").Changed {
+		t.Errorf("expected only the variables set to be recorded, and the flags not marked as changed")
+	}
+}
+
+func TestBindEnvLegacy(t *testing.T) {
+	flags, searchMax, _ := testEnvFlags()
+	t.Setenv(ENV_PAGE_SIZE, "200")
+	sources := map[string]string{}
+	warnings, err := bindEnv(flags, sources)
+	if err != nil || len(warnings) != 1 {
+		t.Fatalf("warnings=%v err=%v", warnings, err)
+	}
+	if *searchMax != 200 || sources["searchMax"] != ENV_PAGE_SIZE {
+		t.Errorf("searchMax=%d sources=%v", *searchMax, sources)
+	}
+
+	// The new variable wins over the legacy one.
+	flags, searchMax, _ = testEnvFlags()
+	t.Setenv("KC_SEARCH_MAX", "300")
+	if warnings, err := bindEnv(flags, map[string]string{}); err != nil || len(warnings) != 1 || *searchMax != 300 {
+		t.Errorf("searchMax=%d warnings=%v err=%v", *searchMax, warnings, err)
+	}
+}
+
+func TestBindEnvInvalid(t *testing.T) {
+	flags, _, _ := testEnvFlags()
+	t.Setenv("KC_DRY_RUN", "maybe")
+	if _, err := bindEnv(flags, map[string]string{}); err == nil {
+		t.Errorf("expected an error for an invalid value")
+	}
+}
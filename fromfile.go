@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// Keycloak user ids are UUIDs, which is how a single column file is told apart from usernames.
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// An NDJSON input line, which also accepts a backup record as the user is nested under `user`.
+type userListEntry struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	User     *struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+}
+
+// readUsersFromFile reads the users to delete from a file, or stdin.
+func readUsersFromFile(path string) ([]userJob, error) {
+	log.Println("[F][START]: Read users from file=", path)
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	users, err := parseUserList(in)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("[F]       : Read ", len(users), " users from file")
+	fmt.Println("[F]       : Read ", len(users), " users from file")
+	log.Println("[F][END]  : Read users from file ********")
+	return users, nil
+}
+
+// parseUserList parses CSV (as produced by `--listOnly` or in its `listFile`, with or without the
+// header) or NDJSON lines into username and id pairs. Either may be empty, but not both. Any other
+// line, such as the indented options printed at the start of a run, is an error rather than being
+// taken for a username.
+func parseUserList(in io.Reader) ([]userJob, error) {
+	var users []userJob
+	scanner := bufio.NewScanner(in)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := scanner.Text()
+		text := strings.TrimSpace(raw)
+		// Skip blanks, the header and the log lines that `--listOnly` prints around the list.
+		if text == "" || text[0] == '[' || text[0] == '#' || isListHeader(text) {
+			continue
+		}
+		if unicode.IsSpace(rune(raw[0])) && text[0] != '{' {
+			return nil, fmt.Errorf("line %d: indented, not a username,id line: %q", line, text)
+		}
+
+		var username, id string
+		if text[0] == '{' {
+			var entry userListEntry
+			if err := json.Unmarshal([]byte(text), &entry); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			username, id = entry.Username, entry.ID
+			if entry.User != nil {
+				username, id = entry.User.Username, entry.User.ID
+			}
+		} else {
+			columns := strings.Split(text, ",")
+			for i := range columns {
+				columns[i] = strings.TrimSpace(columns[i])
+			}
+			switch {
+			// username,id or, from a `listFile` with the cutoff source or policy, username,id,source.
+			case len(columns) == 2 || len(columns) == 3:
+				username, id = columns[0], columns[1]
+				if username == "" || id == "" {
+					return nil, fmt.Errorf("line %d: expected username,id: %q", line, text)
+				}
+			case len(columns) > 3:
+				return nil, fmt.Errorf("line %d: expected username,id: %q", line, text)
+			case uuidPattern.MatchString(text):
+				id = text
+			default:
+				username = text
+			}
+		}
+		if username == "" && id == "" {
+			return nil, fmt.Errorf("line %d: no username or id", line)
+		}
+		// Keycloak usernames and ids never contain whitespace, so a line with any is not a user.
+		if strings.ContainsFunc(username+id, unicode.IsSpace) {
+			return nil, fmt.Errorf("line %d: not a username or id: %q", line, text)
+		}
+		users = append(users, userJob{Username: username, ID: id})
+	}
+	return users, scanner.Err()
+}
+
+// isListHeader returns true for the header of a `--listOnly` list or `listFile`.
+func isListHeader(text string) bool {
+	header := strings.ToLower(strings.ReplaceAll(text, " ", ""))
+	return header == "username,id" || header == "username,id,source" || header == "username,id,policy"
+}
+
+// sameUser returns true unless the job has both a username and an id, and the user found by the
+// id has another username, so a list line naming one user never deletes another.
+func sameUser(job userJob, user *gocloak.User) bool {
+	if job.ID == "" || job.Username == "" {
+		return true
+	}
+	return user.Username != nil && strings.EqualFold(*user.Username, job.Username)
+}
+
+// findUsers looks the user up by id when we have one, otherwise by exact username.
+func findUsers(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, username string, id string) ([]*gocloak.User, error) {
+	if id == "" {
+		return client.GetUsers(ctx, accessToken, targetRealm, gocloak.GetUsersParams{Username: &username, Exact: gocloak.BoolP(true)})
+	}
+	user, err := client.GetUserByID(ctx, accessToken, targetRealm, id)
+	if err != nil {
+		var apiErr *gocloak.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []*gocloak.User{user}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func TestParseUserList(t *testing.T) {
+	// The output of --listOnly, including the log lines around it.
+	in := `[O]       : Total Users In System = 3
+Username,ID
+userA , 0a3b3c1e-8a40-4d5f-9b9a-1c2d3e4f5a6b
+userB,1a3b3c1e-8a40-4d5f-9b9a-1c2d3e4f5a6b
+[O]       : Identified  2  users out of  3  users searched
+2a3b3c1e-8a40-4d5f-9b9a-1c2d3e4f5a6b
+userC
+{"username":"userD"}
+{"runId":"1","user":{"id":"e5","username":"userE"}}
+`
+	users, err := parseUserList(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []userJob{
+		{Username: "userA", ID: "0a3b3c1e-8a40-4d5f-9b9a-1c2d3e4f5a6b"},
+		{Username: "userB", ID: "1a3b3c1e-8a40-4d5f-9b9a-1c2d3e4f5a6b"},
+		{ID: "2a3b3c1e-8a40-4d5f-9b9a-1c2d3e4f5a6b"},
+		{Username: "userC"},
+		{Username: "userD"},
+		{Username: "userE", ID: "e5"},
+	}
+	if len(users) != len(want) {
+		t.Fatalf("got %v, wanted %v", users, want)
+	}
+	for i := range want {
+		if users[i] != want[i] {
+			t.Errorf("line %d got %v, wanted %v", i, users[i], want[i])
+		}
+	}
+
+	if _, err := parseUserList(strings.NewReader(`{"email":"x@example.com"}`)); err == nil {
+		t.Errorf("expected an error for a line without a username or id")
+	}
+
+	// The cutoff source column of a `listFile` is ignored.
+	users, err = parseUserList(strings.NewReader("Username,ID,Source\nuserA,a1,realm\n"))
+	if err != nil || len(users) != 1 || users[0] != (userJob{Username: "userA", ID: "a1"}) {
+		t.Errorf("got %v, %v", users, err)
+	}
+
+	// Anything else is refused, rather than taken for a username.
+	for _, line := range []string{
+		"  Config",
+		"    clientId: admin-cli (default)",
+		"Identified 2 users",
+		"userA,",
+		",a1",
+		"userA,a1,realm,extra",
+		"user A,a1",
+	} {
+		if _, err := parseUserList(strings.NewReader("userB,b2\n" + line + "\n")); err == nil {
+			t.Errorf("expected an error for the line %q", line)
+		}
+	}
+}
+
+func TestSameUser(t *testing.T) {
+	user := &gocloak.User{ID: gocloak.StringP("a1"), Username: gocloak.StringP("usera")}
+	for _, test := range []struct {
+		job  userJob
+		want bool
+	}{
+		{userJob{ID: "a1"}, true},
+		{userJob{Username: "userA"}, true},
+		{userJob{ID: "a1", Username: "userA"}, true},
+		{userJob{ID: "a1", Username: "userB"}, false},
+	} {
+		if got := sameUser(test.job, user); got != test.want {
+			t.Errorf("sameUser(%+v) = %t, wanted %t", test.job, got, test.want)
+		}
+	}
+}
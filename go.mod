@@ -3,10 +3,12 @@ module github.com/bovinemagnet/kc_delete_older_than
 go 1.22.0
 
 require (
+	filippo.io/age v1.2.1
 	github.com/Nerzal/gocloak/v13 v13.9.0
 	github.com/atotto/clipboard v0.1.4
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/spf13/pflag v1.0.5
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -14,5 +16,7 @@ require (
 	github.com/opentracing/opentracing-go v1.2.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/segmentio/ksuid v1.0.4 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
 	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
@@ -0,0 +1,27 @@
+package main
+
+import "sync"
+
+// haltDispatch is closed to stop the workers being given any more users. Users the workers have
+// already been given are still processed.
+var haltDispatch = make(chan struct{})
+var haltOnce sync.Once
+var haltReason string
+
+// halt stops dispatching users to the workers, the first reason given is kept.
+func halt(reason string) {
+	haltOnce.Do(func() {
+		haltReason = reason
+		output(WARNING, true, true, "[M]       : halting, no more users will be dispatched, reason=%s", reason)
+		close(haltDispatch)
+	})
+}
+
+func halted() bool {
+	select {
+	case <-haltDispatch:
+		return true
+	default:
+		return false
+	}
+}
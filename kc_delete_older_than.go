@@ -9,10 +9,11 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	flag "github.com/spf13/pflag"
@@ -39,16 +40,27 @@ var (
 	clientRealm  *string = flag.StringP("clientRealm", "s", CLIENT_REALM, "The realm in which the `clientId` exists")
 	url          *string = flag.StringP("url", "w", URL, "The URL of the keycloak server.")
 	loginAsAdmin *bool   = flag.BoolP("loginAsAdmin", "z", false, "if true, then it will login as admin user, rather than a client.")
+	username     *string = flag.String("username", "", "Login as this user with the password grant, through the `clientId` client (default admin-cli).")
+	password     *string = flag.String("password", "", "The password for the `username`.")
+	// private_key_jwt client authentication
+	clientKeyFile           *string = flag.String("clientKeyFile", "", "PEM private key (RSA for RS256, P-256 EC for ES256) to sign the client assertion with, rather than the `clientSecret`.")
+	clientKeyId             *string = flag.String("clientKeyId", "", "The `kid` of the `clientKeyFile`, in the client's keycloak JWKS.")
+	clientAssertionAudience *string = flag.String("clientAssertionAudience", "", "The audience of the client assertion. (default the realm's token endpoint)")
 	// Target or Destination Realm
 	destinationRealm *string = flag.StringP("destinationRealm", "d", DESTINATION_REALM, "The realm in keycloak where the users are to be created. This may or may not be the same as the `clientRealm`")
 	// Options
 	maxAgeInDays *int  = flag.Int("days", EMPTY_DAYS, "the number of days, after which users are deleted")
 	dryRun       *bool = flag.Bool("dryRun", false, "if true, then no users will be deleted, it will just log the outcome.")
 	showVersion  *bool = flag.Bool("version", false, "if true, Then it will show the version.")
+	// Config file, applied before the environment and command line.
+	configFile   *string = flag.String("config", "", "A YAML or properties file of options, overridden by environment variables and flags.")
+	profileName  *string = flag.String("profile", "", "Use the named profile from the `config` file, for the keycloak server and credentials.")
+	printEnvOnly *bool   = flag.Bool("printEnv", false, "if true, then print the environment variable for every option, and where its value came from.")
 
 	// Logging Options
 	logCmdValues        *bool   = flag.Bool("logCmdValues", false, "if true, then the command line values will be logged.")
 	logDir              *string = flag.String("logDir", os.TempDir(), "The logging directory.")
+	revealSecrets       *bool   = flag.Bool("revealSecrets", false, "if true, then secrets and tokens are printed and logged in clear, for debugging.")
 	listOnly            *bool   = flag.Bool("listOnly", false, "if true, then it will only generate a list the users that will be deleted.")
 	deleteDate          *string = flag.String("deleteDate", "", "The date after which users will be deleted. Format: YYYY-MM-DD")
 	searchMin           *int    = flag.Int("searchMin", 0, "The starting number of users to search through.")
@@ -59,14 +71,90 @@ var (
 	// Validate login only
 	validateLoginOnly *bool = flag.BoolP("validateLoginOnly", "v", false, "if true, then it will only validate the login.")
 	// Headers
-	headerKey   *string = flag.String("headerKey", "", "The header key to use for the login.")
-	headerValue *string = flag.String("headerValue", "", "The header value to use for the login.")
+	headerKey   *string            = flag.String("headerKey", "", "The header key to use for the login.")
+	headerValue *string            = flag.String("headerValue", "", "The header value to use for the login.")
+	headers     *map[string]string = flag.StringToString("headers", map[string]string{}, "Extra headers sent with every request, e.g. `X-Api-Key=abc,X-Tenant=au`.")
+	// TLS
+	tlsCaFile             *string = flag.String("tlsCaFile", "", "PEM file of the CA certificates to trust for keycloak.")
+	tlsCertFile           *string = flag.String("tlsCertFile", "", "PEM client certificate, for mutual TLS.")
+	tlsKeyFile            *string = flag.String("tlsKeyFile", "", "PEM client key, for mutual TLS.")
+	tlsInsecureSkipVerify *bool   = flag.Bool("tlsInsecureSkipVerify", false, "if true, then the keycloak certificate is not verified. Only for testing.")
+	// Deletion limits
+	maxDeletes       *int     = flag.Int("maxDeletes", 0, "Abort if more than this many users would be deleted, 0 is unlimited.")
+	maxDeletePercent *float64 = flag.Float64("maxDeletePercent", 0, "Abort if more than this percentage of the realm's users would be deleted, 0 is unlimited.")
+	overrideLimits   *bool    = flag.Bool("overrideLimits", false, "if true, then exceeding `maxDeletes` or `maxDeletePercent` only warns.")
+	yes              *bool    = flag.BoolP("yes", "y", false, "if true, then users are deleted without asking for confirmation. Required when not run from a terminal.")
+	// Canary
+	canary      *int    = flag.Int("canary", 0, "Delete only the first N users, then pause for verification before deleting the rest.")
+	resumeToken *string = flag.String("resume", "", "Continue a paused run from its resume token (run id) or resume file.")
+	// Batches
+	batchSize  *int           = flag.Int("batchSize", 0, "Delete the users in batches of this size, 0 deletes them all at once.")
+	batchPause *time.Duration = flag.Duration("batchPause", 0, "How long to wait between batches, e.g. `30s` or `5m`.")
+	// Rolling purge
+	limit        *int = flag.Int("limit", 0, "Delete at most this many users in a run, oldest first, 0 is unlimited.")
+	scanPageSize *int = flag.Int("scanPageSize", 0, "Search the `searchMax` users in pages of this size, 0 searches them in one request.")
+	// Maintenance window
+	window *string = flag.String("window", "", "Only delete inside this maintenance window, e.g. `Mon-Fri 01:00-05:00 Australia/Sydney`.")
+	// Shutdown and checkpoints
+	checkpointEvery *int           = flag.Int("checkpointEvery", 100, "Sync the checkpoint journal to disk after this many users have been processed.")
+	shutdownTimeout *time.Duration = flag.Duration("shutdownTimeout", 30*time.Second, "On SIGINT or SIGTERM, wait this long for in-flight deletions before exiting.")
+	// Run lock
+	lockFile  *string        = flag.String("lockFile", "", "The local lock file, defaults to `kc_delete_older_than.<realm>.lock` in the `logDir`.")
+	lockTTL   *time.Duration = flag.Duration("lockTTL", time.Hour, "The lock lease is renewed every third of this, and can be taken over once it has expired.")
+	realmLock *bool          = flag.Bool("realmLock", false, "Also hold the lock as a realm attribute, so runs on other machines are stopped too. Needs manage-realm.")
+	// Pre-deletion notification
+	notify              *bool   = flag.Bool("notify", false, "if true, then it will email users that will cross the cutoff within `notifyDays`, rather than deleting.")
+	notifyDays          *int    = flag.Int("notifyDays", NOTIFY_DAYS, "the number of days before the cutoff that users are notified.")
+	notifyVia           *string = flag.String("notifyVia", NOTIFY_VIA, "How to send the notification, either `keycloak` (execute-actions-email) or `smtp`.")
+	notifyAttribute     *string = flag.String("notifyAttribute", NOTIFY_ATTRIBUTE, "The user attribute that records the date the user was notified.")
+	notifyTemplate      *string = flag.String("notifyTemplate", "", "A text/template file used for the smtp email body.")
+	notifySubject       *string = flag.String("notifySubject", NOTIFY_SUBJECT, "The subject of the smtp email.")
+	notifyActions       *string = flag.String("notifyActions", "", "Comma separated required actions sent with the keycloak execute-actions-email.")
+	notifyLifespan      *int    = flag.Int("notifyLifespan", 0, "The lifespan in seconds of the keycloak execute-actions-email link, 0 uses the realm default.")
+	requireNotification *bool   = flag.Bool("requireNotification", false, "if true, then users that were never notified will not be deleted.")
+	smtpHost            *string = flag.String("smtpHost", "", "The SMTP server used when `notifyVia` is smtp.")
+	smtpPort            *int    = flag.Int("smtpPort", SMTP_PORT, "The SMTP server port.")
+	smtpUsername        *string = flag.String("smtpUsername", "", "The SMTP username, if the server requires authentication.")
+	smtpPassword        *string = flag.String("smtpPassword", "", "The SMTP password, if the server requires authentication.")
+	smtpFrom            *string = flag.String("smtpFrom", "", "The from address of the smtp email.")
+	// Backups
+	backupDir *string = flag.String("backupDir", "", "The directory the deleted user backups are written to, defaults to `logDir`.")
+	// Restore
+	restoreFile  *string = flag.String("restore", "", "A backup file to restore previously deleted users from.")
+	restoreUsers *string = flag.String("restoreUsers", "", "Comma separated usernames or ids to restore from the backup, defaults to all.")
+	restoreRunId *string = flag.String("restoreRunId", "", "Only restore the users deleted by this run id.")
+	// Encryption
+	encryptTo    *string = flag.String("encryptTo", "", "Comma separated age recipients (age1...) or recipient files, the backup and list files are encrypted to.")
+	identityFile *string = flag.String("identityFile", "", "The age identity file used to decrypt backup and list files.")
+	decryptFile  *string = flag.String("decrypt", "", "Decrypt a backup or list file to stdout using the `identityFile`.")
+	listFile     *string = flag.String("listFile", "", "When listing, also write the users to this file.")
+	// Retention policies
+	policyFile *string = flag.String("policyFile", "", "A YAML file of named retention policies, evaluated in order, rather than `days` or `deleteDate`.")
+	// Retention set in keycloak
+	retentionFromKeycloak *bool = flag.Bool("retentionFromKeycloak", false, "if true, then the cutoff is read from the realm and group attributes, falling back to `days` or `deleteDate`.")
+	minRetentionDays      *int  = flag.Int("minRetentionDays", 30, "A cutoff read from the realm or group attributes never deletes users younger than this many days.")
+	explain               *bool = flag.Bool("explain", false, "if true, then print the cutoff, where it came from and the decision for every user searched, and delete nothing.")
+	// Input file
+	fromFile *string = flag.String("fromFile", "", "Delete the users listed in this CSV or NDJSON file, or `-` for stdin, rather than searching keycloak.")
+	// Plan and apply
+	planFile  *string = flag.String("plan", "", "Write the users that would be deleted to this plan file, rather than deleting them.")
+	applyFile *string = flag.String("apply", "", "Delete only the users in this plan file, re-checking each user still matches.")
+	// Plan approval
+	approveFile       *string = flag.String("approve", "", "Sign this plan file with the `signingKey`, as the `approver`.")
+	approver          *string = flag.String("approver", "", "The name of the approver signing the plan, defaults to the current user.")
+	signingKey        *string = flag.String("signingKey", "", "The ed25519 private key (PEM) used to sign the plans you create and approve.")
+	generateKey       *string = flag.String("generateSigningKey", "", "Write a new ed25519 signing key to this file, and print the public key for the `approversFile`.")
+	approversFile     *string = flag.String("approversFile", "", "The trusted approvers, one `name public-key` per line.")
+	requiredApprovals *int    = flag.Int("requiredApprovals", 0, "The number of distinct trusted approvers that must have signed a plan before it is applied. (default 1 with an `approversFile`)")
 )
 
 // var processed uint64
 var processed int32
 var deleted int32
 
+// runId identifies this run in the log, backup and other output files.
+var runId string
+
 func main() {
 
 	// Get the path to the executable file
@@ -79,29 +167,187 @@ func main() {
 	// Get the name of the executable file
 	exeName := filepath.Base(exePath)
 
+	// The config file has the lowest precedence, so apply it first, then the profile from it.
+	path := findArg(os.Args[1:], "config", ENV_CONFIG)
+	profile := findArg(os.Args[1:], "profile", ENV_PROFILE)
+	if profile != "" && path == "" {
+		fmt.Println("[M]  Error: profile=" + profile + " needs a config file, set with --config")
+		os.Exit(1)
+	}
+	if path != "" {
+		if err := loadConfig(flag.CommandLine, path, profile); err != nil {
+			fmt.Println("[M]  Error: config file="+path+" is not valid:", err)
+			os.Exit(1)
+		}
+		*configFile = path
+		*profileName = profile
+	}
+
 	// Parse the env variables
 	parseEnvVariables()
 
 	// Parse the command line arguments
 	flag.Parse()
 
+	if *printEnvOnly {
+		printEnv(os.Stdout, flag.CommandLine)
+		return
+	}
+
 	if *showVersion {
 		fmt.Printf("%s \n [ version=%s ]\n [ commit=%s ]\n [ buildTime=%s ]\n", exeName, version, commit, date)
 		return
 	}
 
+	outputRecipients, err = parseRecipients(*encryptTo)
+	if err != nil {
+		fmt.Println("[M]  Error: encryptTo is not a valid age recipient:", err)
+		return
+	}
+	// With --encryptTo the users listed are not printed, so they would be lost without a listFile.
+	if !printUsers() && (*listOnly || *explain) && !*countTotalUsersOnly && *listFile == "" {
+		fmt.Println("[M]  Error: encryptTo with listOnly or explain also needs a listFile, as the users are not printed")
+		return
+	}
+
+	// Decrypting only writes the plain text to stdout, so nothing else can be printed.
+	if *decryptFile != "" {
+		identities, err := loadIdentities(*identityFile)
+		if err == nil {
+			err = decryptToWriter(*decryptFile, identities, os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[M]  Error: unable to decrypt:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Approving a plan only needs the plan and the key, not keycloak.
+	if *generateKey != "" || *approveFile != "" {
+		name := *approver
+		if name == "" {
+			if current, err := user.Current(); err == nil {
+				name = current.Username
+			}
+		}
+		if *generateKey != "" {
+			publicKey, err := generateSigningKey(*generateKey, name)
+			if err != nil {
+				fmt.Println("[M]  Error: unable to generate signing key:", err)
+				os.Exit(1)
+			}
+			// Only the public key goes to stdout, so it can be appended straight to the approversFile.
+			fmt.Fprintln(os.Stderr, "[M]       : signingKey="+*generateKey+", add this line to the approversFile:")
+			fmt.Println(publicKey)
+			return
+		}
+		if err := approvePlan(*approveFile, name, *signingKey); err != nil {
+			fmt.Println("[M]  Error: unable to approve plan:", err)
+			os.Exit(1)
+		}
+		fmt.Println("[M]       : plan=" + *approveFile + " approved by " + name)
+		return
+	}
+
+	// Secrets can be references to a file, environment variable, command or stdin.
+	secrets := &secretResolver{stdin: os.Stdin}
+	if *fromFile == "-" {
+		secrets.stdinUsedBy = "fromFile"
+	}
+	if err := resolveSecrets(flag.CommandLine, *headers, secrets); err != nil {
+		fmt.Println("[M]  Error: unable to read secret:", err)
+		os.Exit(1)
+	}
+
+	// KC_USERNAME was set by the example scripts before it was read, so is ignored without a password.
+	if *username != "" && *password == "" && valueSource("username") == "[env "+ENV_USERNAME+"]" {
+		fmt.Fprintln(os.Stderr, "[M]  Warning: "+ENV_USERNAME+" is ignored without "+envName("password"))
+		*username = ""
+		delete(envSources, "username")
+	}
+	// The password grant logs in through admin-cli, a public client, unless another client is set.
+	if *username != "" {
+		if *loginAsAdmin {
+			fmt.Println("[M]  Error: username and loginAsAdmin are both set. Please set only one of them.")
+			os.Exit(1)
+		}
+		if *password == "" {
+			fmt.Println("[M]  Error: username=" + *username + " needs a password, set with --password")
+			os.Exit(1)
+		}
+		if valueSource("clientId") == "[default]" {
+			*clientId = PASSWORD_CLIENT_ID
+		}
+		if valueSource("clientSecret") == "[default]" {
+			*clientSecret = ""
+		}
+	}
+
+	clientAssertion, err = loadClientAssertion(*clientKeyFile, *clientKeyId, *clientAssertionAudience)
+	if err != nil {
+		fmt.Println("[M]  Error: clientKeyFile is not valid:", err)
+		os.Exit(1)
+	}
+	if clientAssertion != nil && (*loginAsAdmin || *username != "") {
+		fmt.Println("[M]  Error: clientKeyFile authenticates a client, it can not be used with loginAsAdmin or username.")
+		os.Exit(1)
+	}
+
+	clientTLS, err = loadTLSConfig(*tlsCaFile, *tlsCertFile, *tlsKeyFile, *tlsInsecureSkipVerify)
+	if err != nil {
+		fmt.Println("[M]  Error: TLS settings are not valid:", err)
+		return
+	}
+
+	// A production profile always asks for confirmation, unless --yes is capped by --maxDeletes, and
+	// the cap can not then be overridden.
+	if productionProfile && *yes && *maxDeletes <= 0 {
+		fmt.Println("[M]  Error: profile=" + *profileName + " is production, --yes also needs --maxDeletes")
+		os.Exit(EXIT_NOT_CONFIRMED)
+	}
+	if productionProfile && *yes && *overrideLimits {
+		fmt.Println("[M]  Error: profile=" + *profileName + " is production, --yes can not be combined with --overrideLimits")
+		os.Exit(EXIT_NOT_CONFIRMED)
+	}
+
 	// Display the command line arguments back to the user.
 	if dryRun != nil && *dryRun {
 		printCmdLineArgs()
 	}
 	// if maxAgeInDays and date are both set, then we need to exit.
-	if *maxAgeInDays > EMPTY_DAYS && *deleteDate != "" {
+	if needsDeletionCriteria() && *maxAgeInDays > EMPTY_DAYS && *deleteDate != "" {
 		fmt.Println("[M]  Error: maxAgeInDays and deleteDate are both set. Please set only one of them.")
 		return
 	}
 
+	// Applying a plan uses the criteria in the plan.
+	if *applyFile != "" && hasDeletionCriteria() {
+		fmt.Println("[M]  Error: apply uses the plan's cutoff, maxAgeInDays and deleteDate can not be set.")
+		return
+	}
+
+	// Retention policies carry their own criteria, and choose the users themselves.
+	if *policyFile != "" {
+		if hasDeletionCriteria() || *fromFile != "" || *applyFile != "" || *planFile != "" || *notify {
+			fmt.Println("[M]  Error: policyFile can not be combined with maxAgeInDays, deleteDate, fromFile, plan, apply or notify.")
+			return
+		}
+		policies, err = readPolicies(*policyFile)
+		if err != nil {
+			fmt.Println("[M]  Error: policyFile is not valid:", err)
+			return
+		}
+	}
+
+	// The realm and group attributes only replace searching by `days` or `deleteDate`.
+	if (*retentionFromKeycloak || *explain) && (*policyFile != "" || *fromFile != "" || *applyFile != "" || *planFile != "" || *notify) {
+		fmt.Println("[M]  Error: retentionFromKeycloak and explain can not be combined with policyFile, fromFile, plan, apply or notify.")
+		return
+	}
+
 	// check if neither are set.
-	if *maxAgeInDays <= EMPTY_DAYS && *deleteDate == "" {
+	if needsDeletionCriteria() && *maxAgeInDays <= EMPTY_DAYS && *deleteDate == "" {
 		fmt.Println("[M]  Error: maxAgeInDays and deleteDate are both not set. Please set only one of them.")
 		return
 	}
@@ -115,24 +361,50 @@ func main() {
 		}
 	}
 
+	// Anything else would silently fall back to keycloak.
+	if *notifyVia != NOTIFY_VIA_KEYCLOAK && *notifyVia != NOTIFY_VIA_SMTP {
+		fmt.Println("[M]  Error: notifyVia must be either " + NOTIFY_VIA_KEYCLOAK + " or " + NOTIFY_VIA_SMTP + ", not " + *notifyVia)
+		return
+	}
+
+	// A run outside the maintenance window refuses to start.
+	var maintenance *maintenanceWindow
+	if *window != "" {
+		maintenance, err = parseWindow(*window)
+		if err != nil {
+			fmt.Println("[M]  Error: window is not valid:", err)
+			return
+		}
+		if !maintenance.contains(time.Now()) && needsMaintenanceWindow() {
+			fmt.Println("[M]  ABORT: outside the maintenance window=[" + *window + "], nothing has been deleted.")
+			os.Exit(EXIT_OUTSIDE_WINDOW)
+		}
+	}
+
 	// log the command line arguments to the log file.
 
 	startTimeString := strconv.FormatInt(time.Now().Unix(), 10)
+	runId = startTimeString
 
 	startTime := makeTimestamp()
 
-	f, err := os.OpenFile(*logDir+"/"+startTimeString+"-"+exeName+".log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	f, err := os.OpenFile(*logDir+"/"+startTimeString+"-"+exeName+".log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		log.Fatalf("[M]  error opening file: %v", err)
 	}
 	defer f.Close()
 
-	log.SetOutput(f)
+	log.SetOutput(redactingWriter{f})
 
 	rand.New(rand.NewSource(time.Now().UnixNano()))
 	log.SetFlags(0)
 	logCmdLineArgs()
 
+	// The window can close while searching or waiting for confirmation, so it is enforced from here.
+	if maintenance != nil && needsMaintenanceWindow() {
+		enforceWindow(maintenance, time.Now())
+	}
+
 	u, _ := user.Current()
 
 	success, err := canLogin(*clientRealm, *clientId, *clientSecret, *url, *headerKey, *headerValue)
@@ -150,11 +422,18 @@ func main() {
 		fmt.Println("[M]  SUCCESS: login validated.")
 		return
 	}
+	// Restoring users does not need the deletion criteria.
+	if *restoreFile != "" {
+		log.Println("[M]       : RESTORE MODE")
+		fmt.Println("[M]       : RESTORE MODE")
+		restoreUsersFromBackup(*clientRealm, *clientId, *clientSecret, *url, *restoreFile)
+		return
+	}
 	//
 	var epoch int64
 	if *maxAgeInDays > EMPTY_DAYS {
 		epoch = daysToEpoch(*maxAgeInDays)
-	} else {
+	} else if *deleteDate != "" {
 		epoch, err = parseDateToEpoch(*deleteDate)
 		if err != nil {
 			log.Println("[M]  error parsing date: ", err)
@@ -163,70 +442,361 @@ func main() {
 		}
 	}
 
+	// Applying a plan deletes the users in the plan, against the plan's cutoff.
+	var plan *deletionPlan
+	if *applyFile != "" {
+		plan, err = readPlan(*applyFile)
+		if err == nil {
+			err = verifyPlan(plan, *url, *destinationRealm, approvalsRequired())
+		}
+		var path string
+		if err == nil {
+			path, err = filepath.Abs(*applyFile)
+		}
+		if err != nil {
+			log.Println("[M]  error reading plan: ", err)
+			fmt.Println("[M]  FAIL: error reading plan: ", err)
+			return
+		}
+		epoch = plan.Cutoff
+		appliedPlan = planReference{PlanFile: path, PlanHash: plan.Hash, PlanApprovals: approvalsRequired()}
+		log.Println("[M]       : APPLY plan=", *applyFile, " hash=", plan.Hash, " users=", len(plan.Users))
+		fmt.Println("[M]       : APPLY plan=", *applyFile, " hash=", plan.Hash, " users=", len(plan.Users))
+	}
+
+	// Resuming continues with the users saved by the paused run, rather than searching again.
+	var resume *resumeState
+	if *resumeToken != "" {
+		resume, err = readResumeState(*resumeToken)
+		if err == nil {
+			err = resume.checkTarget(*url, *destinationRealm)
+		}
+		if err == nil {
+			err = resume.checkCriteria(criteriaHash(), hasSelectionCriteria())
+		}
+		// A run applying a plan is resumed with the same protections as --apply.
+		if err == nil {
+			plan, err = resume.checkPlan(*url, *destinationRealm, approvalsRequired())
+		}
+		if err != nil {
+			log.Println("[M]  error reading resume file: ", err)
+			fmt.Println("[M]  FAIL: error reading resume file: ", err)
+			return
+		}
+		epoch = resume.Cutoff
+		if plan != nil {
+			epoch = plan.Cutoff
+			resume.CheckAge = true
+			appliedPlan = resume.planReference
+		}
+		log.Println("[M]       : RESUME runId=", resume.RunID, " reason=", resume.Reason, " users=", len(resume.Users), " processed=", len(resume.Processed))
+		fmt.Println("[M]       : RESUME runId=", resume.RunID, " reason=", resume.Reason, " users=", len(resume.Users), " processed=", len(resume.Processed))
+	}
+
 	log.Println("[M] START : exe=", exeName, " epoch=", strconv.FormatInt(startTime, 10), "user=", u.Username, "olderThan=", epochToDateString(epoch), "currentDate=", epochToDateString(startTime))
 	fmt.Println("[M] START : exe="+exeName+" epoch="+strconv.FormatInt(startTime, 10), " user="+u.Username, "olderThan=", epochToDateString(epoch), "currentDate=", epochToDateString(startTime))
 
-	// If we are list only, or count then we don't need to start the workers.
-	if *listOnly || *countTotalUsersOnly {
+	// Planning writes the users to a file for review, and does not delete anything.
+	if *planFile != "" {
+		log.Println("[M]       : PLAN MODE")
+		fmt.Println("[M]       : PLAN MODE")
+		createPlan(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url, epoch, u.Username, *planFile)
+		return
+	}
+
+	// Notification mode emails the users, and does not delete anything.
+	if *notify {
+		log.Println("[M]       : NOTIFY MODE")
+		fmt.Println("[M]       : NOTIFY MODE")
+		notifyUsersByEpoch(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url, epoch)
+		return
+	}
+
+	// If we are list only, or count then we don't need to start the workers. Listing by policy
+	// groups the candidates by policy, once they have been found.
+	if (*listOnly && *policyFile == "" && !*retentionFromKeycloak && !*explain) || *countTotalUsersOnly {
 		log.Println("[M]       : LIST ONLY MODE")
 		fmt.Println("[M]       : LIST ONLY MODE")
 		listUsersByEpoch(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url, epoch)
 		return
 	}
 
-	wgReceivers := sync.WaitGroup{}
-	wgReceivers.Add(*threads)
+	// Listing by policy or with the cutoff from keycloak searches as a deletion does, but deletes
+	// nothing.
+	listing := *listOnly || *explain
+
+	// Only one run deletes from a realm at a time.
+	if !*dryRun && !listing {
+		if err := acquireRunLock(*destinationRealm); err != nil {
+			log.Println("[M]  ABORT: unable to lock realm=", *destinationRealm, " err=", err)
+			fmt.Println("[M]  ABORT: unable to lock realm="+*destinationRealm+" err=", err)
+			os.Exit(EXIT_LOCKED)
+		}
+		defer releaseRunLock()
+	}
+
+	// Users from a file have not been checked against the age criteria yet, so the workers do it.
+	checkAge := false
+	if resume != nil {
+		checkAge = resume.CheckAge
+	} else if plan != nil {
+		checkAge = true
+	} else if *fromFile != "" {
+		checkAge = hasDeletionCriteria()
+	}
+
+	// A checkpoint is kept while deleting, so that a crashed run can be resumed. A resumed run
+	// carries on with the checkpoint of the run it resumes.
+	if !*dryRun && !listing {
+		state := newResumeState(epoch, checkAge)
+		if resume != nil {
+			*state = *resume
+			state.RunID = runId
+		} else if plan == nil && *fromFile == "" {
+			state.Scanning = true
+			state.ScanPosition = *searchMin
+		}
+		state.Reason = "checkpoint"
+		checkpoint, err = startCheckpoint(state, *checkpointEvery)
+		if err != nil {
+			log.Println("[M]  error writing checkpoint: ", err)
+			fmt.Println("[M]  FAIL: error writing checkpoint: ", err)
+			return
+		}
+		if resume != nil && resumePath(*resumeToken) != checkpoint.path {
+			removeResumeState(*resumeToken)
+		}
+		log.Println("[M]       : checkpoint=", checkpoint.path, " resume with --resume=", runId)
+		fmt.Println("[M]       : checkpoint=" + checkpoint.path + " resume with --resume=" + runId)
+	}
+
+	// Find every user before any worker starts, so the deletion limits can be checked.
+	var candidates []userJob
+	var totalUsers int
+	selected := createdBefore(epoch)
+	if policies != nil {
+		selected = selectByPolicy(policies)
+	} else if *retentionFromKeycloak || *explain {
+		retention = newKeycloakRetention(*retentionFromKeycloak, daysToEpoch(*minRetentionDays), epoch, hasDeletionCriteria())
+		selected = retention.selector(*explain)
+	}
+	if resume != nil && resume.Scanning {
+		candidates, totalUsers, err = readUsersFromKeycloak(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url, selected, resume.ScanPosition, resume.pending())
+	} else if resume != nil {
+		candidates = resume.pending()
+		totalUsers, err = countUsers(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url)
+	} else if plan != nil {
+		candidates = plan.Users
+		totalUsers, err = countUsers(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url)
+	} else if *fromFile != "" {
+		candidates, err = readUsersFromFile(*fromFile)
+		if err == nil {
+			totalUsers, err = countUsers(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url)
+		}
+	} else {
+		candidates, totalUsers, err = readUsersFromKeycloak(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url, selected, *searchMin, nil)
+	}
+	if err != nil {
+		log.Println("[M]  error finding users: ", err)
+		fmt.Println("[M]  FAIL: error finding users: ", err)
+		return
+	}
+
+	// Listing with the cutoff from keycloak shows where each user's cutoff came from.
+	if retention != nil && listing {
+		listWithCutoffSource(candidates)
+		return
+	}
+
+	// Each policy's action, limit and deletion limits apply to the users attributed to it.
+	if policies != nil {
+		printPolicyCandidates(policies, candidates)
+		if listing {
+			writePolicyList(candidates)
+			return
+		}
+		candidates, err = applyPolicies(policies, candidates, totalUsers, *overrideLimits)
+		if err != nil {
+			log.Println("[M]  ABORT: ", err, ", nothing has been deleted. Use --overrideLimits if this is intended.")
+			fmt.Println("[M]  ABORT:", err.Error()+", nothing has been deleted. Use --overrideLimits if this is intended.")
+			stopCheckpoint()
+			exitRun(EXIT_LIMIT_EXCEEDED)
+		}
+	}
+
+	// A rolling purge deletes at most `limit` users a run, always the oldest first.
+	sortOldestFirst(candidates)
+	candidates, backlog := limitCandidates(candidates, *limit)
+	if len(backlog) > 0 {
+		log.Println("[M]       : LIMIT deleting ", len(candidates), " users, leaving a backlog of ", len(backlog))
+		fmt.Println("[M]       : LIMIT deleting ", len(candidates), " users, leaving a backlog of ", len(backlog))
+	}
+	checkpoint.scanned(*searchMin+*searchMax, candidates, true)
+
+	if err := checkDeletionLimits(len(candidates), totalUsers, *maxDeletes, *maxDeletePercent); err != nil {
+		if !*overrideLimits {
+			log.Println("[M]  ABORT: ", err, ", nothing has been deleted. Use --overrideLimits if this is intended.")
+			fmt.Println("[M]  ABORT:", err.Error()+", nothing has been deleted. Use --overrideLimits if this is intended.")
+			stopCheckpoint()
+			exitRun(EXIT_LIMIT_EXCEEDED)
+		}
+		log.Println("[M]  WARNING: ", err, ", overridden by --overrideLimits")
+		fmt.Println("[M]  WARNING:", err.Error()+", overridden by --overrideLimits")
+	}
+
+	// The window closed while searching, so don't ask to delete users that won't be, resume next window.
+	if halted() && !*dryRun {
+		exitWithResume(haltReason, candidates, epoch, checkAge)
+	}
+
+	// Nothing is deleted without an explicit --yes, or the operator typing the realm name.
+	if !*dryRun && !*yes {
+		cutoff := "none"
+		if checkAge || *fromFile == "" {
+			cutoff = epochToDateString(epoch)
+		}
+		if !isInteractive() {
+			log.Println("[M]  WARNING: not a terminal and --yes not given, running as a dry run")
+			fmt.Println("[M]  WARNING: not a terminal and --yes not given, running as a dry run")
+			*dryRun = true
+			stopCheckpoint()
+		} else if !confirmDeletion(os.Stdin, os.Stdout, *url, *destinationRealm, cutoff, len(candidates)) {
+			log.Println("[M]  ABORT: deletion not confirmed, nothing has been deleted.")
+			fmt.Println("[M]  ABORT: deletion not confirmed, nothing has been deleted.")
+			stopCheckpoint()
+			exitRun(EXIT_NOT_CONFIRMED)
+		} else {
+			log.Println("[M]       : deletion confirmed by ", u.Username)
+		}
+	}
+
+	// Every user is backed up before it is deleted, so open the backup file before the workers start.
+	var backup *backupWriter
+	if !*dryRun {
+		dir := *backupDir
+		if dir == "" {
+			dir = *logDir
+		}
+		backupName := dir + "/" + startTimeString + "-" + exeName + ".backup.ndjson"
+		if len(outputRecipients) > 0 {
+			backupName += ".enc"
+		}
+		backup, err = openBackupWriter(backupName)
+		if err != nil {
+			log.Println("[M]  error opening backup file: ", err)
+			fmt.Println("[M]  FAIL: error opening backup file: ", err)
+			return
+		}
+		defer backup.Close()
+		log.Println("[M]       : backup=", backup.Name())
+		fmt.Println("[M]       : backup=" + backup.Name())
+	}
 
-	usersChannel := make(chan []string, *channelBuffer)
 	resultsChannel := make(chan string, *channelBuffer)
-	go readUsersFromKeycloak(*clientRealm, *clientId, *clientSecret, *destinationRealm, *url, epoch, usersChannel)
+	resultsWritten := make(chan struct{})
+	go writeLog(resultsChannel, resultsWritten)
+	// flushResults waits for the results to be logged, once the workers have finished.
+	flushResults := func() {
+		close(resultsChannel)
+		<-resultsWritten
+	}
+	summary := func(success bool) {
+		endTime := makeTimestamp()
+		duration := endTime - startTime
+		println("[M]       : processed=" + strconv.FormatInt(int64(processed), 10))
+		println("[M]       : deleted=" + strconv.FormatInt(int64(deleted), 10))
+		if len(backlog) > 0 {
+			oldest := backlog[0].CreatedTimestamp
+			println("[M]       : backlog=" + strconv.Itoa(len(backlog)) + " oldestRemaining=" + epochToDateString(oldest) + " (" + strconv.Itoa(daysSinceCreation(oldest)) + " days old)")
+			log.Println("[M]       : backlog=", len(backlog), " oldestRemaining=", epochToDateString(oldest), " (", daysSinceCreation(oldest), " days old)")
+		}
+		for _, line := range policySummary(policies) {
+			println("[M]       : " + line)
+			log.Println("[M]       : ", line)
+		}
+		if backup != nil {
+			println("[M]       : backup=" + backup.Name())
+		}
+		println("[M]       : logging=" + f.Name() + " path copied to clipboard (maybe)")
+		clipboard.WriteAll(f.Name())
+		println("[M] END   : export_success=" + strconv.FormatBool(success) + " epoch=" + strconv.FormatInt(endTime, 10) + " duration=" + strconv.FormatInt(duration, 10) + "ms" + " processed=" + strconv.FormatInt(int64(processed), 10))
+		log.Println("[M] END   : export_success=", success, " duration=", duration, "ms processed=", processed, " deleted=", deleted)
+	}
+	// stopWithResume flushes the results and prints the partial summary, before saving the users
+	// that were not processed and exiting.
+	stopWithResume := func(reason string, remaining []userJob) {
+		flushResults()
+		summary(false)
+		if backup != nil {
+			backup.Close()
+		}
+		exitWithResume(reason, remaining, epoch, checkAge)
+	}
 
-	go writeLog(resultsChannel)
+	shutdownOnSignal()
 
-	for i := 0; i < *threads; i++ {
-		go deleteUserWorker(i, *clientRealm, *clientId, *clientSecret, *destinationRealm, *url, *dryRun, *loginAsAdmin, usersChannel, resultsChannel, &wgReceivers)
+	// A canary deletes the first few users, then pauses so downstream systems can be checked.
+	if *canary > 0 && !*dryRun && len(candidates) > *canary {
+		canaryUsers, remaining := candidates[:*canary], candidates[*canary:]
+		log.Println("[M]       : CANARY users=", len(canaryUsers))
+		fmt.Println("[M]       : CANARY users=", len(canaryUsers))
+		for _, job := range canaryUsers {
+			log.Println("[M]       : CANARY ", job.Username, ",", job.ID)
+			fmt.Println("[M]       : CANARY ", job.Username, ",", job.ID)
+		}
+		if notDispatched := deleteUsers(canaryUsers, checkAge, epoch, backup, resultsChannel); len(notDispatched) > 0 {
+			stopWithResume(haltReason, append(notDispatched, remaining...))
+		}
+		log.Println("[M]       : CANARY complete, deleted=", deleted, ", remaining=", len(remaining))
+		fmt.Println("[M]       : CANARY complete, deleted=", deleted, ", remaining=", len(remaining))
+
+		if !isInteractive() || !confirmContinue(os.Stdin, os.Stdout, *destinationRealm, len(remaining)) {
+			stopWithResume("canary", remaining)
+		}
+		candidates = remaining
 	}
 
-	wgReceivers.Wait()
+	var remaining []userJob
+	if *batchSize > 0 {
+		remaining = deleteInBatches(candidates, checkAge, epoch, backup, resultsChannel)
+	} else {
+		remaining = deleteUsers(candidates, checkAge, epoch, backup, resultsChannel)
+	}
+	if len(remaining) > 0 {
+		stopWithResume(haltReason, remaining)
+	}
+	stopCheckpoint()
+	flushResults()
+	summary(true)
+}
 
-	endTime := makeTimestamp()
-	duration := endTime - startTime
-	println("[M]       : processed=" + strconv.FormatInt(int64(processed), 10))
-	println("[M]       : deleted=" + strconv.FormatInt(int64(deleted), 10))
-	println("[M]       : logging=" + f.Name() + " path copied to clipboard (maybe)")
-	clipboard.WriteAll(f.Name())
-	println("[M] END   : export_success=true epoch=" + strconv.FormatInt(endTime, 10) + " duration=" + strconv.FormatInt(duration, 10) + "ms" + " processed=" + strconv.FormatInt(int64(processed), 10))
+// needsDeletionCriteria returns false for the modes that do not use `days` or `deleteDate`, or
+// where they are optional.
+func needsDeletionCriteria() bool {
+	return *restoreFile == "" && *fromFile == "" && *applyFile == "" && *resumeToken == "" && *policyFile == "" && !*retentionFromKeycloak
+}
+
+// needsMaintenanceWindow returns false for the modes that never delete users.
+func needsMaintenanceWindow() bool {
+	return !*dryRun && !*listOnly && !*explain && !*countTotalUsersOnly && *planFile == "" && !*notify && !*validateLoginOnly
+}
 
+func hasDeletionCriteria() bool {
+	return *maxAgeInDays > EMPTY_DAYS || *deleteDate != ""
 }
 
 func canLogin(clientRealmName string, clientId string, clientSecret string, url string, headerName string, headerValue string) (bool, error) {
 	log.Println("[V][START]: Validate Login ********")
 
-	var client *gocloak.GoCloak
-	if *useLegacyKeycloak {
-		// This is for older versions of Keycloak that is based on WildFly
-		client = gocloak.NewClient(url, gocloak.SetLegacyWildFlySupport())
-	} else {
-		// This is for newer versions of Keycloak, that is based on quarkus
-		client = gocloak.NewClient(url)
-	}
-	// Add the custom header set, if configured.
-	if strings.TrimSpace(headerName) != "" && strings.TrimSpace(headerValue) != "" {
-		client.RestyClient().Header.Set(headerName, headerValue)
-	}
+	client := newClient(url, headerName, headerValue)
 
 	ctx := context.Background()
 	var token *gocloak.JWT
 	var err error
-	if *loginAsAdmin {
-		log.Println("[V]       : logging into keycloak via admin")
-		token, err = client.LoginAdmin(ctx, clientId, clientSecret, clientRealmName)
-	} else {
-		log.Println("[V]       : logging into keycloak via client")
-		token, err = client.LoginClient(ctx, clientId, clientSecret, clientRealmName)
-	}
+	log.Println("[V]       : logging into keycloak via " + loginMode(*loginAsAdmin))
+	token, err = authenticate(ctx, client, url, clientRealmName, clientId, clientSecret, *loginAsAdmin)
 	if err != nil {
-		log.Println("[V]       : token=", token)
+		log.Println("[V]       : token=", describeToken(token))
 		log.Println("[V]       : err=", err)
 		log.Println("[V][END]  : Validate Login ********")
 
@@ -262,7 +832,7 @@ func canLogin(clientRealmName string, clientId string, clientSecret string, url
 		fmt.Printf("[V]       : Token will expire in: %d hours %d minutes %d seconds\n", hours, minutes, seconds)
 		log.Printf("[V]       : Token will expire in: %d hours %d minutes %d seconds\n", hours, minutes, seconds)
 
-		log.Println("[V]       : Login Validation Success", token)
+		log.Println("[V]       : Login Validation Success", describeToken(token))
 		log.Println("[V][END]  : Validate Login ********")
 		return true, nil
 	}
@@ -279,35 +849,19 @@ func listUsersByEpoch(realmName string, clientId string, clientSecret string, ta
 	log.Println("[O][START]: Fetch users from keycloak ********")
 	log.Println("[O]       : login")
 
-	var client *gocloak.GoCloak
-	if *useLegacyKeycloak {
-		// This is for older versions of Keycloak that is based on WildFly
-		client = gocloak.NewClient(url, gocloak.SetLegacyWildFlySupport())
-	} else {
-		// This is for newer versions of Keycloak, that is based on quarkus
-		client = gocloak.NewClient(url)
-	}
-	// set the header values if they exist.
-	if (headerKey != nil && strings.TrimSpace(*headerKey) != "") && (headerValue != nil && strings.TrimSpace(*headerValue) != "") {
-		client.RestyClient().Header.Set(*headerKey, *headerValue)
-	}
+	client := newClient(url, *headerKey, *headerValue)
 	ctx := context.Background()
 	log.Println("[O]       : logging into keycloak")
 	var token *gocloak.JWT
 	var err error
-	if *loginAsAdmin {
-		log.Println("[O]       : logging into keycloak via admin")
-		token, err = client.LoginAdmin(ctx, clientId, clientSecret, realmName)
-	} else {
-		log.Println("[O]       : logging into keycloak via client")
-		token, err = client.LoginClient(ctx, clientId, clientSecret, realmName)
-	}
+	log.Println("[O]       : logging into keycloak via " + loginMode(*loginAsAdmin))
+	token, err = authenticate(ctx, client, url, realmName, clientId, clientSecret, *loginAsAdmin)
 	if err != nil {
-		log.Println("[O]       : ", token)
+		log.Println("[O]       : ", describeToken(token))
 		log.Println("[O]       : ", err)
 		return
 	} else {
-		log.Println("[O]       : Login Success", token)
+		log.Println("[O]       : Login Success", describeToken(token))
 	}
 	// Fetch the list of Keycloak users
 	log.Println("[O]       : fetching users from keycloak")
@@ -350,10 +904,12 @@ func listUsersByEpoch(realmName string, clientId string, clientSecret string, ta
 	// Delete users that were created more than 7 days ago
 	log.Println("[O]       : adding user to deletion queue")
 	// get the count of users
-	if len(users) > 0 {
+	if len(users) > 0 && printUsers() {
 		fmt.Println("Username,ID")
 		log.Println("Username,ID")
 	}
+	var list strings.Builder
+	list.WriteString("Username,ID\n")
 
 	for _, user := range users {
 
@@ -364,11 +920,23 @@ func listUsersByEpoch(realmName string, clientId string, clientSecret string, ta
 
 		if deleteEpochTime >= *user.CreatedTimestamp {
 			// Add the user to the deletion queue
-			fmt.Println(*user.Username, ",", *user.ID)
-			log.Println(*user.Username, ",", *user.ID)
+			if printUsers() {
+				fmt.Println(*user.Username, ",", *user.ID)
+				log.Println(*user.Username, ",", *user.ID)
+			}
+			list.WriteString(*user.Username + "," + *user.ID + "\n")
 			counter++
 		}
 	}
+	if *listFile != "" {
+		if err := writeOutputFile(*listFile, []byte(list.String())); err != nil {
+			fmt.Println("[O]       : Error writing listFile:", err)
+			log.Println("[O]       : Error writing listFile:", err)
+		} else {
+			fmt.Println("[O]       : listFile=", *listFile, " encrypted=", len(outputRecipients) > 0)
+			log.Println("[O]       : listFile=", *listFile, " encrypted=", len(outputRecipients) > 0)
+		}
+	}
 	if len(users) > 0 && counter == 0 {
 		fmt.Println("[O]       : No users=[0] found in the searchWindow=[", *searchMax, "] search window, older than ", epochToDateString(deleteEpochTime))
 		log.Println("[O]       : No users=[0] found in the searchWindow=[", *searchMax, "]  older than ", epochToDateString(deleteEpochTime))
@@ -382,101 +950,80 @@ func listUsersByEpoch(realmName string, clientId string, clientSecret string, ta
 
 }
 
-// reads file and adds data it to the channel
-func readUsersFromKeycloak(realmName string, clientId string, clientSecret string, targetRealm string, url string, deleteEpochTime int64, jobs chan []string) {
-
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("[PANIC]: ", r.(string))
-			println("panic:" + r.(string))
-		}
-	}()
-
+// readUsersFromKeycloak searches keycloak for the users to delete from position, adding to the users
+// already found by an earlier run. They are returned along with the total number of users in the
+// realm.
+func readUsersFromKeycloak(realmName string, clientId string, clientSecret string, targetRealm string, url string, selected userSelector, position int, found []userJob) ([]userJob, int, error) {
 	log.Println("[R][START]: Fetch users from keycloak ********")
 	log.Println("[R]       : login")
 
-	var client *gocloak.GoCloak
-	if *useLegacyKeycloak {
-		// This is for older versions of Keycloak that is based on WildFly
-		client = gocloak.NewClient(url, gocloak.SetLegacyWildFlySupport())
-	} else {
-		// This is for newer versions of Keycloak, that is based on quarkus
-		client = gocloak.NewClient(url)
-	}
-	// set the header values if they exist.
-	if (headerKey != nil && strings.TrimSpace(*headerKey) != "") && (headerValue != nil && strings.TrimSpace(*headerValue) != "") {
-		client.RestyClient().Header.Set(*headerKey, *headerValue)
-	}
-	ctx := context.Background()
-	log.Println("[R]       : logging into keycloak")
-	var token *gocloak.JWT
-	var err error
-	if *loginAsAdmin {
-		log.Println("[R]       : logging into keycloak via admin")
-		token, err = client.LoginAdmin(ctx, clientId, clientSecret, realmName)
-	} else {
-		log.Println("[R]       : logging into keycloak via client")
-		token, err = client.LoginClient(ctx, clientId, clientSecret, realmName)
-	}
+	validate := false
+	client, token, err := login(realmName, clientId, clientSecret, url, *headerKey, *headerValue, loginAsAdmin, &validate)
 	if err != nil {
-		log.Println("[R]       : ", token)
-		log.Println("[R]       : ", err)
-		close(jobs)
-		return
-	} else {
-		log.Println("[R]       : Login Success", token)
+		return nil, 0, err
 	}
+	ctx := context.Background()
+
 	// Fetch the list of Keycloak users
 	log.Println("[R]       : fetching users from keycloak")
-	userParams := gocloak.GetUsersParams{}
-	userParams.Max = searchMax
-	userParams.First = searchMin
-
-	totalUsers, err := client.GetUserCount(ctx, token.AccessToken, targetRealm, userParams)
+	totalUsers, err := client.GetUserCount(ctx, token.AccessToken, targetRealm, gocloak.GetUsersParams{})
 	if err != nil {
-		return
+		return nil, 0, err
 	}
 	log.Println("[R]       : Total Users In System =", totalUsers)
 	fmt.Println("[R]       : Total Users In System =", totalUsers)
 
-	users, err := client.GetUsers(ctx, token.AccessToken, targetRealm, userParams)
+	if err := loadGroupMembers(ctx, client, token.AccessToken, targetRealm, policies); err != nil {
+		return nil, 0, err
+	}
+	if err := retention.load(ctx, client, token.AccessToken, targetRealm); err != nil {
+		return nil, 0, err
+	}
+	candidates, searched, err := scanCandidates(ctx, client, token.AccessToken, targetRealm, selected, position, found)
 	if err != nil {
-		//fmt.Println("Error fetching users:", err)
 		log.Println("[R]       : Error fetching users:", err)
-		close(jobs)
-		return
+		return nil, 0, err
 	}
+	log.Println("[R]       : Found ", len(candidates), " users to delete out of ", strconv.Itoa(searched), STRING_USERS_SEARCHED)
+	fmt.Println("[R]       : Found ", len(candidates), " users to delete out of ", strconv.Itoa(searched), STRING_USERS_SEARCHED)
+	log.Println("[R][END]  : reading keycloak users *******************************************")
 
-	var counter int32 = 0
+	return candidates, totalUsers, nil
+}
 
-	// Delete users that were created more than 7 days ago
-	log.Println("[R]       : adding user to deletion queue")
-	for _, user := range users {
-		//fmt.Println("[R] User", user)
-		//ageInDays := daysSinceCreation(*user.CreatedTimestamp)
-		if deleteEpochTime >= *user.CreatedTimestamp {
-			// Add the user to the deletion queue
-			jobs <- []string{*user.Username, *user.ID}
-			counter++
-		}
-	}
-	log.Println("[R]       : Added ", counter, " users to deletion queue out of ", strconv.Itoa(len(users)), STRING_USERS_SEARCHED)
+// deleteUsers runs the worker pool over the users, and returns once the dispatched users have all
+// been processed. Users are handed to the workers one at a time, so that a halt stops promptly, and
+// the users that were never dispatched are returned.
+func deleteUsers(users []userJob, checkAge bool, deleteEpochTime int64, backup *backupWriter, results chan string) []userJob {
+	wgReceivers := sync.WaitGroup{}
+	wgReceivers.Add(*threads)
 
-	log.Println("[R][END]  : reading keycloak users *******************************************")
+	usersChannel := make(chan userJob)
+	workersDone := make(chan struct{})
+	notDispatched := make(chan []userJob, 1)
+	go func() {
+		notDispatched <- feedJobs(users, usersChannel, workersDone)
+	}()
 
-	// As there are many threads adding to the counter, lets do the addition atomically
-	atomic.AddInt32(&processed, counter)
+	for i := 0; i < *threads; i++ {
+		go deleteUserWorker(i, *clientRealm, *clientId, *clientSecret, *destinationRealm, *url, *dryRun, *loginAsAdmin, checkAge, deleteEpochTime, backup, usersChannel, results, &wgReceivers)
+	}
 
-	close(jobs)
+	// Workers exit early when they can not log in, so stop dispatching to them once they all have.
+	wgReceivers.Wait()
+	close(workersDone)
+	return <-notDispatched
 }
 
-func writeLog(results chan string) {
+// writeLog logs the results until the channel is closed, then closes done.
+func writeLog(results chan string, done chan struct{}) {
+	defer close(done)
 	for j := range results {
 		log.Println("[L] RSLT  : ", j)
 	}
 }
 
-func deleteUserWorker(id int, realmName string, clientId string, clientSecret string, targetRealm string, url string, dryRun bool, loginAsAdmin bool, jobs <-chan []string, results chan<- string, wg *sync.WaitGroup) {
+func deleteUserWorker(id int, realmName string, clientId string, clientSecret string, targetRealm string, url string, dryRun bool, loginAsAdmin bool, checkAge bool, deleteEpochTime int64, backup *backupWriter, jobs <-chan userJob, results chan<- string, wg *sync.WaitGroup) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("[D] panic : ", r.(string))
@@ -488,32 +1035,16 @@ func deleteUserWorker(id int, realmName string, clientId string, clientSecret st
 	successCounter := 0
 	log.Println("[D][", id, "]  : Bulk User Tool Starting")
 
-	var client *gocloak.GoCloak
-	if *useLegacyKeycloak {
-		// This is for older versions of Keycloak that is based on WildFly
-		client = gocloak.NewClient(url, gocloak.SetLegacyWildFlySupport())
-	} else {
-		// This is for newer versions of Keycloak, that is based on quarkus
-		client = gocloak.NewClient(url)
-	}
-	// set the header values if they exist.
-	if (headerKey != nil && strings.TrimSpace(*headerKey) != "") && (headerValue != nil && strings.TrimSpace(*headerValue) != "") {
-		client.RestyClient().Header.Set(*headerKey, *headerValue)
-	}
+	client := newClient(url, *headerKey, *headerValue)
 	ids := strconv.Itoa(id)
 	ctx := context.Background()
 	log.Println("[D][", ids, "]  : logging into keycloak")
 	var token *gocloak.JWT
 	var err error
-	if loginAsAdmin {
-		log.Println("[D]       : logging into keycloak via admin")
-		token, err = client.LoginAdmin(ctx, clientId, clientSecret, realmName)
-	} else {
-		log.Println("[D]       : logging into keycloak via client")
-		token, err = client.LoginClient(ctx, clientId, clientSecret, realmName)
-	}
+	log.Println("[D]       : logging into keycloak via " + loginMode(loginAsAdmin))
+	token, err = authenticate(ctx, client, url, realmName, clientId, clientSecret, loginAsAdmin)
 	if err != nil {
-		log.Println("[D][", ids, "] ", token)
+		log.Println("[D][", ids, "] ", describeToken(token))
 		log.Println("[D][", ids, "] ", err)
 		log.Println("[D][", ids, "] clientId=", clientId)
 		fmt.Println("[D][", ids, "] clientId=["+clientId+"]")
@@ -523,64 +1054,101 @@ func deleteUserWorker(id int, realmName string, clientId string, clientSecret st
 		//panic("[D][" + ids + "] Something wrong with the credentials or url : Error: " + err.Error())
 	}
 
-	for channelData := range jobs {
+	for job := range jobs {
 		ok := true
 
-		log.Println("[D][", ids, "]  : Looking for ", channelData[0])
-		users, err := client.GetUsers(
-			ctx,
-			token.AccessToken,
-			targetRealm,
-			gocloak.GetUsersParams{
-				Username: &channelData[0]})
+		log.Println("[D][", ids, "]  : Looking for ", job.Username, job.ID)
+		users, err := findUsers(ctx, client, token.AccessToken, targetRealm, job.Username, job.ID)
+		if err != nil && err.Error() == "401 Unauthorized: HTTP 401 Unauthorized" {
+			// if we get a 401, the token has expired, so get a new one and look the user up again.
+			log.Println("[C][", ids, "] : refresh token attempt")
+			fmt.Println("[C][", ids, "] : refresh token attempt")
+			newToken, authErr := reauthenticate(ctx, client, url, token, realmName, clientId, clientSecret, loginAsAdmin)
+			if authErr != nil {
+				log.Println("[C][", ids, "] : exiting thread due to 401, refresh token failed "+authErr.Error())
+				fmt.Println("[C][", ids, "] : exiting thread due to 401, refresh token failed "+authErr.Error())
+				return
+			}
+			log.Println("[C][", ids, "] : refresh token success", describeToken(newToken))
+			token = newToken
+			users, err = findUsers(ctx, client, token.AccessToken, targetRealm, job.Username, job.ID)
+		}
 		if err != nil {
-
 			if err.Error() == "401 Unauthorized: HTTP 401 Unauthorized" {
-				// if we get a 401, then we need to re-login.
-				log.Println("[C][", ids, "] : refresh token attempt")
-				fmt.Println("[C][", ids, "] : refresh token attempt")
-				//wg.Done()
-				// try to refresh the token
-				newToken, err := client.RefreshToken(ctx, token.RefreshToken, clientId, clientSecret, realmName)
-				if err != nil {
-					//panic(err)
-					log.Println("[C][", ids, "] : exiting thread due to 401, refresh token failed "+err.Error())
-					fmt.Println("[C][", ids, "] : exiting thread due to 401, refresh token failed "+err.Error())
-					return
-				} else {
-					log.Println("[C][", ids, "] : refresh token success "+newToken.AccessToken)
-				}
-			} else {
-				panic("[D][" + ids + "] user=" + channelData[0] + " Delete users failed. error=" + err.Error())
+				// The user was not looked up, so it is failed rather than not found, and a resumed
+				// run tries it again.
+				results <- "[D][" + ids + "] " + job.Username + " lookup unauthorized, not deleted"
+				recordOutcome(job, OUTCOME_FAILED)
+				continue
 			}
+			panic("[D][" + ids + "] user=" + job.Username + " Delete users failed. error=" + err.Error())
 		}
 		userID := ""
+		var found *gocloak.User
 		for _, userFnd := range users {
 			log.Println("[D][", ids, "]  : FOUND ", *userFnd.ID, " ", *userFnd.Username)
 			userID = *userFnd.ID
+			found = userFnd
 		}
 		if userID == "" {
-			log.Println("[D][", ids, "] ", channelData[0], "User not found")
-			results <- "[" + ids + "] " + channelData[0] + " User not found"
-
+			log.Println("[D][", ids, "] ", job.Username, "User not found")
+			results <- "[" + ids + "] " + job.Username + " User not found"
+			recordOutcome(job, OUTCOME_NOT_FOUND)
+
+		} else if !sameUser(job, found) {
+			// The id and the username in the list are not the same user.
+			log.Println("[D][", ids, "] ", job.Username, "User id=", userID, " has another username, skipping")
+			results <- "[D][" + ids + "] " + job.Username + " " + userID + " id belongs to another username, not deleted"
+			recordOutcome(job, OUTCOME_SKIPPED)
+			ok = false
+		} else if job.CreatedTimestamp != 0 && (found.CreatedTimestamp == nil || *found.CreatedTimestamp != job.CreatedTimestamp) {
+			// Not the user that was selected, it has been recreated since.
+			log.Println("[D][", ids, "] ", job.Username, "User changed since it was selected, skipping")
+			results <- "[D][" + ids + "] " + job.Username + " " + userID + " changed since it was selected, not deleted"
+			recordOutcome(job, OUTCOME_SKIPPED)
+			ok = false
+		} else if checkAge && (found.CreatedTimestamp == nil || *found.CreatedTimestamp > deleteEpochTime) {
+			// The user list came from elsewhere, so the age criteria is only a safety check.
+			log.Println("[D][", ids, "] ", job.Username, "User newer than ", epochToDateString(deleteEpochTime), ", skipping")
+			results <- "[D][" + ids + "] " + job.Username + " " + userID + " newer than cutoff, not deleted"
+			recordOutcome(job, OUTCOME_SKIPPED)
+			ok = false
+		} else if *requireNotification && !notifiedDaysAgo(found, *notifyDays, time.Now()) {
+			// The policy requires a warning email, at least `notifyDays` before deletion.
+			log.Println("[D][", ids, "] ", job.Username, "User not notified", *notifyDays, "days ago, skipping")
+			results <- "[D][" + ids + "] " + job.Username + " " + userID + " not notified " + strconv.Itoa(*notifyDays) + " days ago, not deleted"
+			recordOutcome(job, OUTCOME_SKIPPED)
+			ok = false
 		} else {
 
 			if !dryRun {
-				err := client.DeleteUser(ctx, token.AccessToken, targetRealm, userID)
+				// Never delete a user that we could not back up first.
+				record, err := fetchBackupRecord(ctx, client, token.AccessToken, targetRealm, userID)
+				if err == nil {
+					err = backup.Write(record)
+				}
 				if err != nil {
+					log.Println("[D][", ids, "] backup user error : ", err.Error())
+					results <- "[D][" + ids + "] " + job.Username + " " + userID + " backup failed, not deleted " + err.Error()
+					recordOutcome(job, OUTCOME_FAILED)
+					ok = false
+				} else if err := client.DeleteUser(ctx, token.AccessToken, targetRealm, userID); err != nil {
 					log.Println("[D][", ids, "] delete user error : ", err.Error())
 					ok = false
 					//panic("Oh no!, failed to create user :(")
 					// set the return error code.
-					results <- "[D][" + ids + "] " + channelData[0] + " " + userID + " " + err.Error()
+					results <- "[D][" + ids + "] " + job.Username + " " + userID + " " + err.Error()
+					recordOutcome(job, OUTCOME_FAILED)
 				} else {
 					// if we need more logging.
 					//log.Println(ids, "]deleted user success : ", createdUser)
 					ok = true
 					deleted++
+					recordOutcome(job, OUTCOME_DELETED)
 				}
 			} else {
-				results <- "[D][" + ids + "] " + channelData[0] + " " + userID + " dry run"
+				results <- "[D][" + ids + "] " + job.Username + " " + userID + " dry run"
+				recordOutcome(job, OUTCOME_DRY_RUN)
 				ok = true
 			}
 		}
@@ -589,7 +1157,7 @@ func deleteUserWorker(id int, realmName string, clientId string, clientSecret st
 		// and we add the return message.
 		if ok {
 			successCounter++
-			results <- "[D][" + ids + "] " + channelData[0] + "  : successfully deleted"
+			results <- "[D][" + ids + "] " + job.Username + "  : successfully deleted"
 		}
 	}
 
@@ -684,135 +1252,23 @@ func epochToDateString(epoch int64) string {
 	return time.Unix(0, epoch*int64(time.Millisecond)).Format(DateFormat)
 }
 
-/*
- * Parse the environmental variables, this will be overridden by the command line arguments.
- */
+// parseEnvVariables sets the flags from their `KC_` environment variables, see envName.
 func parseEnvVariables() {
-
-	envClientId := os.Getenv(ENV_CLIENT_ID)
-	if envClientId != "" {
-		*clientId = envClientId
-	}
-	envClientSecret := os.Getenv(ENV_CLIENT_SECRET)
-	if envClientSecret != "" {
-		*clientSecret = envClientSecret
-	}
-	envClientRealm := os.Getenv(ENV_CLIENT_REALM)
-	if envClientRealm != "" {
-		*clientRealm = envClientRealm
-	}
-	envDestinationRealm := os.Getenv(ENV_DESTINATION_REALM)
-	if envDestinationRealm != "" {
-		*destinationRealm = envDestinationRealm
-	}
-	envUrl := os.Getenv(ENV_URL)
-	if envUrl != "" {
-		*url = envUrl
-	}
-	envDryRun := os.Getenv(ENV_DRY_RUN)
-	if envDryRun != "" {
-		*dryRun = envDryRun == "true"
-	}
-
-	envLogCmdValues := os.Getenv(ENV_LOG_CMD_VALUES)
-	if envLogCmdValues != "" {
-		*logCmdValues = envLogCmdValues == "true"
+	warnings, err := bindEnv(flag.CommandLine, envSources)
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "[M]  Warning:", warning)
 	}
-
-	// Override the value for using the legacy keycloak client url, ie `/admin`
-	envUseLegacy := os.Getenv(ENV_USE_LEGACY_KEYCLOAK)
-	if envUseLegacy != "" {
-		*useLegacyKeycloak = strings.ToUpper(envUseLegacy) == "TRUE"
+	if err != nil {
+		fmt.Println("[M]  Error: environment variable is not valid:", err)
+		os.Exit(1)
 	}
 
-	envLogDir := os.Getenv(ENV_LOG_DIR)
-	if envLogDir != "" {
+	if env, ok := envSources["logDir"]; ok {
 		//check if the logging location exists
-		if _, err := os.Stat(envLogDir); os.IsNotExist(err) {
+		if _, err := os.Stat(*logDir); os.IsNotExist(err) {
 			log.Fatal("Error logging directory does not exist: ", err)
-			panic("Error logging directory does not exist: " + ENV_LOG_DIR + err.Error())
+			panic("Error logging directory does not exist: " + env + err.Error())
 		}
-		*logDir = envLogDir
-	}
-
-	envLoginAsAdmin := os.Getenv(ENV_LOGIN_AS_ADMIN)
-	if envLoginAsAdmin != "" {
-		*loginAsAdmin = envLoginAsAdmin == "true"
-	}
-
-	envDeleteDate := os.Getenv(ENV_MAX_AGE_IN_DATE)
-	if envDeleteDate != "" {
-		*deleteDate = envDeleteDate
-	}
-
-	var err error
-
-	envDays := os.Getenv(ENV_MAX_AGE_IN_DAYS)
-	if envDays != "" {
-		*maxAgeInDays, err = strconv.Atoi(envDays)
-		if err != nil {
-			log.Fatal("Error parsing days from env variable: ", err)
-			panic(ERROR_PARSING_ENV_VER + ENV_MAX_AGE_IN_DAYS + err.Error())
-		}
-	}
-
-	envThreads := os.Getenv(ENV_THREADS)
-	if envThreads != "" {
-		*threads, err = strconv.Atoi(envThreads)
-		if err != nil {
-			log.Fatal(ERROR_PARSING_ENV_VER, err)
-			//fmt.Fatal("Error parsing threads from env variable: ", err)
-			panic(ERROR_PARSING_ENV_VER + ENV_THREADS + err.Error())
-		}
-	}
-
-	envChannelBuffer := os.Getenv(ENV_CHANNEL_BUFFER)
-	if envChannelBuffer != "" {
-		*channelBuffer, err = strconv.Atoi(envChannelBuffer)
-		if err != nil {
-			log.Fatal("Error parsing channel buffer from env variable: ", err)
-			panic("Error parsing channelBuffer from env variable:" + ENV_CHANNEL_BUFFER + err.Error())
-		}
-	}
-
-	envPageSize := os.Getenv(ENV_PAGE_SIZE)
-	if envPageSize != "" {
-		*searchMax, err = strconv.Atoi(envPageSize)
-		if err != nil {
-			log.Fatal("Error parsing page size from env variable: ", err)
-			panic("Error parsing pageSize from env variable:" + ENV_PAGE_SIZE + err.Error())
-		}
-	}
-
-	envPageOffset := os.Getenv(ENV_PAGE_OFFSET)
-	if envPageOffset != "" {
-		*searchMin, err = strconv.Atoi(envPageOffset)
-		if err != nil {
-			log.Fatal("Error parsing page offset from env variable: ", err)
-			panic("Error parsing pageOffset from env variable:" + ENV_PAGE_OFFSET + err.Error())
-		}
-	}
-
-	// Note this will not allow the header value to be null. need to think about this more.
-	envHeaderName := os.Getenv(ENV_HEADER_NAME)
-	if strings.TrimSpace(envHeaderName) != "" {
-		envHeaderValue := os.Getenv(ENV_HEADER_VALUE)
-		if strings.TrimSpace(envHeaderValue) != "" {
-			*headerKey = envHeaderName
-			*headerValue = envHeaderValue
-		}
-	}
-
-	// Check if the user wants to only count the total number of users.
-	envCountOnly := os.Getenv(ENV_COUNT_ONLY)
-	if envCountOnly != "" {
-		*countTotalUsersOnly = envCountOnly == "true"
-	}
-
-	// Check if the user wants to only list the users that will be deleted.
-	envListUsers := os.Getenv(ENV_LIST_ONLY)
-	if envListUsers != "" {
-		*listOnly = envListUsers == "true"
 	}
 
 	logCmdLineArgs()
@@ -822,36 +1278,28 @@ func parseEnvVariables() {
 // Function that accepts an io.Writer to print or log
 func outputCmdLineArgs(out io.Writer) {
 	fmt.Fprintln(out, "[KeyCloak Delete via API Tool (Day/Date Based)]")
-	fmt.Fprintln(out, "  Authentication:")
-	fmt.Fprintln(out, "    clientId:", *clientId)
-	fmt.Fprintln(out, "    clientSecret:", *clientSecret)
-	fmt.Fprintln(out, "    clientRealm:", *clientRealm)
-	fmt.Fprintln(out, "    destinationRealm:", *destinationRealm)
-	fmt.Fprintln(out, "    loginAsAdmin:", *loginAsAdmin)
-	fmt.Fprintln(out, "    url:", *url)
-	fmt.Fprintln(out, "    useLegacyKeycloak:", *useLegacyKeycloak)
-	fmt.Fprintln(out, "  Concurrency")
-	fmt.Fprintln(out, "    channelBuffer:", *channelBuffer)
-	fmt.Fprintln(out, "    threads:", *threads)
-	fmt.Fprintln(out, "  Deletion Criteria")
+	fmt.Fprintln(out, "    production:", productionProfile)
+	// Every option is printed, so a new one is never left out of the log.
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintln(out, "    "+f.Name+":", cmdLineValue(f), valueSource(f.Name))
+	})
+	fmt.Fprintln(out, " ")
+}
 
-	if *maxAgeInDays > EMPTY_DAYS {
-		fmt.Fprintln(out, "    maxDaysInAge:", *maxAgeInDays, "[", daysToDate(*maxAgeInDays), "]")
-	} else {
-		fmt.Fprintln(out, "    maxDaysInAge:", "disabled")
+// cmdLineValue returns the option's value to print, with the secrets and the header values masked.
+func cmdLineValue(f *flag.Flag) string {
+	switch {
+	case slices.Contains(secretFlags, f.Name):
+		return maskSecret(f.Value.String())
+	case f.Name == "headers":
+		names := make([]string, 0, len(*headers))
+		for name, value := range *headers {
+			names = append(names, name+"="+maskSecret(value))
+		}
+		sort.Strings(names)
+		return "[" + strings.Join(names, ",") + "]"
+	case f.Name == "days" && *maxAgeInDays > EMPTY_DAYS:
+		return f.Value.String() + " [ " + daysToDate(*maxAgeInDays) + " ]"
 	}
-	if *deleteDate != "" {
-		fmt.Fprintln(out, "    deleteDate:", *deleteDate)
-	} else {
-		fmt.Fprintln(out, "    deleteDate:", "Disabled")
-	}
-	fmt.Fprintln(out, "  Misc Config")
-	fmt.Fprintln(out, "    dryRun:", *dryRun)
-	fmt.Fprintln(out, "    logCmdValues:", *logCmdValues)
-	fmt.Fprintln(out, "    logDir:", *logDir)
-	fmt.Fprintln(out, "    searchMin:", *searchMin)
-	fmt.Fprintln(out, "    searchMax:", *searchMax)
-	fmt.Fprintln(out, "    countTotalUsersOnly:", *countTotalUsersOnly)
-	fmt.Fprintln(out, "    listOnly:", *listOnly)
-	fmt.Fprintln(out, " ")
+	return f.Value.String()
 }
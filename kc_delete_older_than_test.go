@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	flag "github.com/spf13/pflag"
 )
 
 func TestDaysSinceCreation(t *testing.T) {
@@ -77,3 +83,49 @@ func TestParseDate(t *testing.T) {
 		t.Errorf("Expected %v, but got %v", expectedDate, actualDate)
 	}
 }
+
+func TestDeleteUsersWhenNoWorkerCanLogin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	savedURL, savedThreads := *url, *threads
+	*url, *threads = server.URL, 2
+	defer func() { *url, *threads = savedURL, savedThreads }()
+
+	users := []userJob{{ID: "1", Username: "a"}, {ID: "2", Username: "b"}, {ID: "3", Username: "c"}}
+	results := make(chan string, len(users))
+	notDispatched := make(chan []userJob, 1)
+	go func() {
+		notDispatched <- deleteUsers(users, false, 0, nil, results)
+	}()
+	select {
+	case remaining := <-notDispatched:
+		if len(remaining) != len(users) {
+			t.Errorf("remaining=%v, wanted every user returned as not dispatched", remaining)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("deleteUsers did not return after every worker failed to log in")
+	}
+}
+
+func TestOutputCmdLineArgs(t *testing.T) {
+	defer func(secret string, values map[string]string) { *clientSecret, *headers = secret, values }(*clientSecret, *headers)
+	*clientSecret = "a-client-secret"
+	*headers = map[string]string{"X-Api-Key": "an-api-key"}
+
+	var out bytes.Buffer
+	outputCmdLineArgs(&out)
+	printed := out.String()
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if !strings.Contains(printed, "    "+f.Name+":") {
+			t.Errorf("option %s is not printed", f.Name)
+		}
+	})
+	if strings.Contains(printed, "a-client-secret") || strings.Contains(printed, "an-api-key") {
+		t.Errorf("secrets are printed in clear:\n%s", printed)
+	}
+	if !strings.Contains(printed, "X-Api-Key="+MASK) {
+		t.Errorf("header names are not printed:\n%s", printed)
+	}
+}
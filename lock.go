@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// runLease is held by the run deleting from a realm, in the local lock file and optionally in a
+// realm attribute. It is renewed while the run is alive, so a lease that has expired was left by a
+// run that died, and can be taken over. The holder identifies the run, as two runs started in the
+// same second share a run id.
+type runLease struct {
+	Holder     string    `json:"holder"`
+	Owner      string    `json:"owner"`
+	Host       string    `json:"host"`
+	PID        int       `json:"pid"`
+	RunID      string    `json:"runId"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+func newRunLease(now time.Time, ttl time.Duration) runLease {
+	owner := "unknown"
+	if u, err := user.Current(); err == nil {
+		owner = u.Username
+	}
+	host, _ := os.Hostname()
+	return runLease{Holder: newLeaseHolder(host, os.Getpid()), Owner: owner, Host: host, PID: os.Getpid(), RunID: runId, AcquiredAt: now, ExpiresAt: now.Add(ttl)}
+}
+
+// newLeaseHolder returns an id unique to this run: the host, the pid and random bytes.
+func newLeaseHolder(host string, pid int) string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("%s/%d/%s", host, pid, hex.EncodeToString(random))
+}
+
+func (l runLease) String() string {
+	return fmt.Sprintf("%s@%s pid=%d runId=%s expires=%s", l.Owner, l.Host, l.PID, l.RunID, l.ExpiresAt.Format(time.RFC3339))
+}
+
+// checkLease returns an error when another run holds an unexpired lease.
+func checkLease(existing runLease, holder string, now time.Time) error {
+	if existing.Holder == holder || now.After(existing.ExpiresAt) {
+		return nil
+	}
+	return fmt.Errorf("locked by %s", existing)
+}
+
+// lockPath is the local lock file for the realm, in the `logDir` unless `lockFile` is set.
+func lockPath(realm string) string {
+	if *lockFile != "" {
+		return *lockFile
+	}
+	return filepath.Join(*logDir, "kc_delete_older_than."+realm+".lock")
+}
+
+func readLockFile(path string) (runLease, error) {
+	var lease runLease
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return lease, err
+	}
+	return lease, json.Unmarshal(data, &lease)
+}
+
+// acquireLockFile creates the lock file, taking it over when the lease in it has expired.
+func acquireLockFile(path string, lease runLease, now time.Time) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			defer file.Close()
+			_, err = file.Write(data)
+			return err
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		existing, err := readLockFile(path)
+		if err == nil {
+			if err := checkLease(existing, lease.Holder, now); err != nil {
+				return err
+			}
+			output(WARNING, true, true, "[K]       : taking over the stale lock=%s held by %s", path, existing)
+		} else {
+			output(WARNING, true, true, "[K]       : taking over the unreadable lock=%s err=%s", path, err)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return fmt.Errorf("unable to acquire lock=%s", path)
+}
+
+// releaseLockFile removes the lock file, unless another run has taken it over.
+func releaseLockFile(path string, holder string) error {
+	existing, err := readLockFile(path)
+	if err != nil {
+		return err
+	}
+	if existing.Holder != holder {
+		return fmt.Errorf("lock=%s is now held by %s", path, existing)
+	}
+	return os.Remove(path)
+}
+
+// realmLease reads the lease from the realm attributes, the realm has no lease when ok is false.
+func realmLease(realm *gocloak.RealmRepresentation) (lease runLease, ok bool, err error) {
+	if realm.Attributes == nil || (*realm.Attributes)[LOCK_ATTRIBUTE] == "" {
+		return lease, false, nil
+	}
+	err = json.Unmarshal([]byte((*realm.Attributes)[LOCK_ATTRIBUTE]), &lease)
+	return lease, true, err
+}
+
+// setRealmLease writes, or with a nil lease removes, the holder's lease in the realm attributes.
+// Keycloak has no compare and swap, so the lease is read back to check that another run did not
+// write it at the same time.
+func setRealmLease(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, holder string, lease *runLease, now time.Time) error {
+	realm, err := client.GetRealm(ctx, accessToken, targetRealm)
+	if err != nil {
+		return err
+	}
+	existing, ok, err := realmLease(realm)
+	if err != nil {
+		output(WARNING, true, true, "[K]       : taking over the unreadable realm lock err=%s", err)
+	} else if ok {
+		if err := checkLease(existing, holder, now); err != nil {
+			return err
+		}
+		if existing.Holder != holder {
+			output(WARNING, true, true, "[K]       : taking over the stale realm lock held by %s", existing)
+		}
+	}
+
+	attributes := map[string]string{}
+	if realm.Attributes != nil {
+		attributes = *realm.Attributes
+	}
+	if lease == nil {
+		delete(attributes, LOCK_ATTRIBUTE)
+	} else {
+		data, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		attributes[LOCK_ATTRIBUTE] = string(data)
+	}
+	realm.Attributes = &attributes
+	if err := client.UpdateRealm(ctx, accessToken, *realm); err != nil {
+		return err
+	}
+	if lease == nil {
+		return nil
+	}
+
+	realm, err = client.GetRealm(ctx, accessToken, targetRealm)
+	if err != nil {
+		return err
+	}
+	if current, ok, err := realmLease(realm); err != nil || !ok || current.Holder != holder {
+		return fmt.Errorf("lost the realm lock to %s", current)
+	}
+	return nil
+}
+
+// runLock is the lock held by this run.
+type runLock struct {
+	mu       sync.Mutex
+	lease    runLease
+	path     string
+	realm    string
+	stop     chan struct{}
+	released bool
+}
+
+var heldLock *runLock
+
+// acquireRunLock stops two runs deleting from the same realm at once. The lease is renewed every
+// third of `lockTTL` until it is released.
+func acquireRunLock(targetRealm string) error {
+	now := time.Now()
+	lock := &runLock{lease: newRunLease(now, *lockTTL), path: lockPath(targetRealm), stop: make(chan struct{})}
+	if err := acquireLockFile(lock.path, lock.lease, now); err != nil {
+		return err
+	}
+	if *realmLock {
+		lock.realm = targetRealm
+		if err := lock.writeRealmLease(&lock.lease, now); err != nil {
+			os.Remove(lock.path)
+			return err
+		}
+	}
+	heldLock = lock
+	output(INFO, true, true, "[K]       : acquired lock=%s realmLock=%t by %s", lock.path, *realmLock, lock.lease)
+
+	go func() {
+		ticker := time.NewTicker(*lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lock.stop:
+				return
+			case now := <-ticker.C:
+				lock.renew(now)
+			}
+		}
+	}()
+	return nil
+}
+
+func (l *runLock) writeRealmLease(lease *runLease, now time.Time) error {
+	validate := false
+	client, token, err := login(*clientRealm, *clientId, *clientSecret, *url, *headerKey, *headerValue, loginAsAdmin, &validate)
+	if err != nil {
+		return err
+	}
+	return setRealmLease(context.Background(), client, token.AccessToken, l.realm, l.lease.Holder, lease, now)
+}
+
+// renew extends the lease. If it has been lost, no more users are dispatched.
+func (l *runLock) renew(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return
+	}
+	l.lease.ExpiresAt = now.Add(*lockTTL)
+	data, err := json.Marshal(l.lease)
+	if err == nil {
+		if existing, rerr := readLockFile(l.path); rerr == nil && existing.Holder != l.lease.Holder {
+			err = fmt.Errorf("lock=%s is now held by %s", l.path, existing)
+		} else {
+			err = os.WriteFile(l.path, data, 0600)
+		}
+	}
+	if err == nil && l.realm != "" {
+		err = l.writeRealmLease(&l.lease, now)
+	}
+	if err != nil {
+		output(ERROR, true, true, "[K]       : unable to renew the lock err=%s", err)
+		halt("lock")
+	}
+}
+
+// releaseRunLock releases the lock, if this run holds one.
+func releaseRunLock() {
+	if heldLock == nil {
+		return
+	}
+	l := heldLock
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return
+	}
+	l.released = true
+	close(l.stop)
+	if err := releaseLockFile(l.path, l.lease.Holder); err != nil {
+		output(WARNING, true, true, "[K]       : unable to release the lock err=%s", err)
+	}
+	if l.realm != "" {
+		if err := l.writeRealmLease(nil, time.Now()); err != nil {
+			output(WARNING, true, true, "[K]       : unable to release the realm lock err=%s", err)
+		}
+	}
+	output(INFO, true, true, "[K]       : released lock=%s", l.path)
+}
+
+// releaseLocalLock removes the local lock file only, for when the run has to exit immediately.
+func releaseLocalLock() {
+	if heldLock != nil {
+		releaseLockFile(heldLock.path, heldLock.lease.Holder)
+	}
+}
+
+// exitRun releases the lock before exiting.
+func exitRun(code int) {
+	releaseRunLock()
+	os.Exit(code)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckLease(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	held := runLease{Holder: "ops1/100/aa", Owner: "alice", Host: "ops1", RunID: "1700000000", ExpiresAt: now.Add(time.Minute)}
+
+	if err := checkLease(held, "ops1/101/bb", now); err == nil {
+		t.Errorf("expected an error for a lease held by another run")
+	}
+	if err := checkLease(held, "ops1/100/aa", now); err != nil {
+		t.Errorf("Unexpected error renewing our own lease: %v", err)
+	}
+	if err := checkLease(held, "ops1/101/bb", now.Add(2*time.Minute)); err != nil {
+		t.Errorf("Unexpected error taking over an expired lease: %v", err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delete.lock")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	first := runLease{Holder: "ops1/100/aa", Owner: "alice", RunID: "1700000000", ExpiresAt: now.Add(time.Hour)}
+	second := runLease{Holder: "ops2/100/bb", Owner: "bob", RunID: "1700000001", ExpiresAt: now.Add(time.Hour)}
+	// Started in the same second, so with the same run id.
+	sameSecond := runLease{Holder: "ops1/101/cc", Owner: "alice", RunID: "1700000000", ExpiresAt: now.Add(time.Hour)}
+
+	if err := acquireLockFile(path, first, now); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := acquireLockFile(path, second, now); err == nil {
+		t.Fatalf("expected the second run to be locked out")
+	}
+	if err := acquireLockFile(path, sameSecond, now); err == nil {
+		t.Fatalf("expected a run started in the same second to be locked out")
+	}
+	if err := releaseLockFile(path, second.Holder); err == nil {
+		t.Errorf("expected an error releasing another run's lock")
+	}
+
+	// Once the first run's lease has expired, the second run takes it over.
+	if err := acquireLockFile(path, second, now.Add(2*time.Hour)); err != nil {
+		t.Fatalf("Unexpected error taking over the stale lock: %v", err)
+	}
+	got, err := readLockFile(path)
+	if err != nil || got.Holder != second.Holder {
+		t.Errorf("lock=%+v err=%v", got, err)
+	}
+	if err := releaseLockFile(path, second.Holder); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := acquireLockFile(path, first, now); err != nil {
+		t.Errorf("Unexpected error after release: %v", err)
+	}
+}
+
+func TestNewLeaseHolder(t *testing.T) {
+	if a, b := newLeaseHolder("ops1", 100), newLeaseHolder("ops1", 100); a == b {
+		t.Errorf("expected a unique holder, got %s twice", a)
+	}
+}
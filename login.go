@@ -10,32 +10,67 @@ import (
 	jwt "github.com/golang-jwt/jwt/v5"
 )
 
-func login(clientRealmName string, clientId string, clientSecret string, url string, headerName string, headerValue string, loginAsAdmin *bool, validateLogin *bool) (*gocloak.GoCloak, *gocloak.JWT, error) {
-	output(ERROR, true, false, "[L][START]: Login ********")
+// loginMode describes how the tool logs in, for the log.
+func loginMode(loginAsAdmin bool) string {
+	switch {
+	case *username != "":
+		return "password as " + *username
+	case loginAsAdmin:
+		return "admin"
+	case clientAssertion != nil:
+		return "client with a signed JWT"
+	default:
+		return "client"
+	}
+}
 
-	var client *gocloak.GoCloak
-	if *useLegacyKeycloak {
-		// This is for older versions of Keycloak that is based on WildFly
-		client = gocloak.NewClient(url, gocloak.SetLegacyWildFlySupport())
-	} else {
-		// This is for newer versions of Keycloak, that is based on quarkus
-		client = gocloak.NewClient(url)
+// authenticate gets a token: as a named user with the password grant when `username` is set,
+// through the `clientId` client (its secret is empty for a public client), as the admin user with
+// `loginAsAdmin`, or otherwise as the client itself, with a signed JWT when `clientKeyFile` is set.
+// The token is redacted from the output.
+func authenticate(ctx context.Context, client *gocloak.GoCloak, url string, realm string, clientId string, clientSecret string, loginAsAdmin bool) (*gocloak.JWT, error) {
+	var token *gocloak.JWT
+	var err error
+	switch {
+	case *username != "":
+		token, err = client.Login(ctx, clientId, clientSecret, realm, *username, *password)
+	case loginAsAdmin:
+		token, err = client.LoginAdmin(ctx, clientId, clientSecret, realm)
+	case clientAssertion != nil:
+		token, err = clientAssertion.login(ctx, client, url, realm, clientId)
+	default:
+		token, err = client.LoginClient(ctx, clientId, clientSecret, realm)
 	}
-	if (headerName != "") && (headerValue != "") {
-		client.RestyClient().Header.Set(headerName, headerValue)
+	addToken(token)
+	return token, err
+}
+
+// reauthenticate gets a new token once the token has expired, by refreshing it, or by logging in
+// again when there is no refresh token or it has expired too. A client authenticated by a signed JWT
+// always logs in again, as refreshing would need the client secret.
+func reauthenticate(ctx context.Context, client *gocloak.GoCloak, url string, token *gocloak.JWT, realm string, clientId string, clientSecret string, loginAsAdmin bool) (*gocloak.JWT, error) {
+	if clientAssertion == nil && token != nil && token.RefreshToken != "" {
+		newToken, err := client.RefreshToken(ctx, token.RefreshToken, clientId, clientSecret, realm)
+		if err == nil {
+			addToken(newToken)
+			return newToken, nil
+		}
+		log.Println("[L]       : refresh token failed, logging in again err=", err)
 	}
+	return authenticate(ctx, client, url, realm, clientId, clientSecret, loginAsAdmin)
+}
+
+func login(clientRealmName string, clientId string, clientSecret string, url string, headerName string, headerValue string, loginAsAdmin *bool, validateLogin *bool) (*gocloak.GoCloak, *gocloak.JWT, error) {
+	output(ERROR, true, false, "[L][START]: Login ********")
+
+	client := newClient(url, headerName, headerValue)
 	ctx := context.Background()
 	var token *gocloak.JWT
 	var err error
-	if *loginAsAdmin {
-		log.Println("[L]       : logging into keycloak via admin")
-		token, err = client.LoginAdmin(ctx, clientId, clientSecret, clientRealmName)
-	} else {
-		log.Println("[L]       : logging into keycloak via client")
-		token, err = client.LoginClient(ctx, clientId, clientSecret, clientRealmName)
-	}
+	log.Println("[L]       : logging into keycloak via " + loginMode(*loginAsAdmin))
+	token, err = authenticate(ctx, client, url, clientRealmName, clientId, clientSecret, *loginAsAdmin)
 	if err != nil {
-		output(ERROR, true, false, "[L]       : token=%v", token)
+		output(ERROR, true, false, "[L]       : token=%s", describeToken(token))
 		output(ERROR, true, false, "[L]       : err=%s", err)
 		output(ERROR, true, false, "[L][END]  : Login ********")
 
@@ -77,7 +112,7 @@ func login(clientRealmName string, clientId string, clientSecret string, url str
 
 		output(INFO, true, true, "[L]        : Token will expire in: %d hours %d minutes %d seconds\n", hours, minutes, seconds)
 
-		output(INFO, true, false, "[L]       : Login Validation Success. token=%v", token)
+		output(INFO, true, false, "[L]       : Login Validation Success. token=%s", describeToken(token))
 		output(INFO, true, false, "[L][END]  : Validate Login ********")
 		return client, token, nil
 	}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func TestLoginMode(t *testing.T) {
+	if got := loginMode(false); got != "client" {
+		t.Errorf("loginMode=%s, want client", got)
+	}
+	if got := loginMode(true); got != "admin" {
+		t.Errorf("loginMode=%s, want admin", got)
+	}
+	*username = "jsmith"
+	defer func() { *username = "" }()
+	if got := loginMode(false); got != "password as jsmith" {
+		t.Errorf("loginMode=%s, want password as jsmith", got)
+	}
+}
+
+// testTokenServer is a token endpoint that refuses refresh tokens, and returns a new token for
+// any other grant, recording the grants asked for.
+func testTokenServer(t *testing.T, grants *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		*grants = append(*grants, r.Form.Get("grant_type"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("grant_type") == "refresh_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"new-access-token","expires_in":60}`))
+	}))
+}
+
+func TestReauthenticate(t *testing.T) {
+	var grants []string
+	server := testTokenServer(t, &grants)
+	defer server.Close()
+	*username, *password = "jsmith", "secret"
+	defer func() { *username, *password = "", "" }()
+	client := gocloak.NewClient(server.URL)
+
+	// An expired refresh token falls back to logging in again.
+	token, err := reauthenticate(context.Background(), client, server.URL, &gocloak.JWT{RefreshToken: "expired"}, "master", "admin-cli", "", false)
+	if err != nil || token.AccessToken != "new-access-token" {
+		t.Fatalf("token=%v err=%v", token, err)
+	}
+	if len(grants) != 2 || grants[0] != "refresh_token" || grants[1] != "password" {
+		t.Errorf("grants=%v, want [refresh_token password]", grants)
+	}
+
+	// Without a refresh token, it logs in again straight away.
+	grants = nil
+	if _, err := reauthenticate(context.Background(), client, server.URL, &gocloak.JWT{}, "master", "admin-cli", "", false); err != nil || len(grants) != 1 || grants[0] != "password" {
+		t.Errorf("grants=%v err=%v", grants, err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+const millisecondsInDay = int64(24 * 60 * 60 * 1000)
+
+// The template used when `--notifyTemplate` is not set.
+const defaultNotifyTemplate = `Hello {{.FirstName}},
+
+The account "{{.Username}}" in {{.Realm}} is scheduled to be deleted on or after {{.DeletionDate}}.
+
+If you wish to keep this account, please contact your administrator before that date.
+`
+
+// The values available to the notification template.
+type notifyData struct {
+	Username     string
+	FirstName    string
+	LastName     string
+	Email        string
+	Realm        string
+	DeletionDate string
+}
+
+// notifyUsersByEpoch sends a warning email to every user that will cross the deletion cutoff within
+// `--notifyDays`, and records the date they were notified in the `--notifyAttribute` user attribute.
+func notifyUsersByEpoch(realmName string, clientId string, clientSecret string, targetRealm string, url string, deleteEpochTime int64) {
+	output(INFO, true, true, "[N][START]: Notify users ********")
+
+	tmpl, err := loadNotifyTemplate(*notifyTemplate)
+	if err != nil {
+		output(ERROR, true, true, "[N]       : unable to load template=%s err=%s", *notifyTemplate, err)
+		return
+	}
+
+	validate := false
+	client, token, err := login(realmName, clientId, clientSecret, url, *headerKey, *headerValue, loginAsAdmin, &validate)
+	if err != nil {
+		output(ERROR, true, true, "[N]       : login failed err=%s", err)
+		return
+	}
+	ctx := context.Background()
+
+	userParams := gocloak.GetUsersParams{}
+	userParams.First = searchMin
+	userParams.Max = searchMax
+	users, err := client.GetUsers(ctx, token.AccessToken, targetRealm, userParams)
+	if err != nil {
+		output(ERROR, true, true, "[N]       : Error fetching users: %s", err)
+		return
+	}
+
+	now := nowAsUnixMilliseconds()
+	windowEnd := deleteEpochTime + int64(*notifyDays)*millisecondsInDay
+	output(INFO, true, true, "[N]       : notifying users created on or before %s via %s", epochToDateString(windowEnd), *notifyVia)
+
+	var candidates, notified, alreadyNotified, failed int
+	for _, user := range users {
+		if user.CreatedTimestamp == nil || *user.CreatedTimestamp > windowEnd {
+			continue
+		}
+		candidates++
+		if hasBeenNotified(user) {
+			alreadyNotified++
+			continue
+		}
+		data := notifyData{
+			Username:     gocloak.PString(user.Username),
+			FirstName:    gocloak.PString(user.FirstName),
+			LastName:     gocloak.PString(user.LastName),
+			Email:        gocloak.PString(user.Email),
+			Realm:        targetRealm,
+			DeletionDate: deletionDateFor(*user.CreatedTimestamp, deleteEpochTime, now),
+		}
+		if data.Email == "" {
+			output(WARNING, true, true, "[N]       : %s has no email address, skipping", data.Username)
+			failed++
+			continue
+		}
+		if *dryRun {
+			output(INFO, true, true, "[N]       : %s <%s> would be notified of deletion on %s (dry run)", data.Username, data.Email, data.DeletionDate)
+			notified++
+			continue
+		}
+
+		if *notifyVia == NOTIFY_VIA_SMTP {
+			body, err := renderNotifyTemplate(tmpl, data)
+			if err == nil {
+				err = sendNotifySMTP(data.Email, *notifySubject, body)
+			}
+			if err != nil {
+				output(ERROR, true, true, "[N]       : %s unable to send email err=%s", data.Username, err)
+				failed++
+				continue
+			}
+		} else {
+			if err := sendNotifyKeycloak(ctx, client, token.AccessToken, targetRealm, *user.ID); err != nil {
+				output(ERROR, true, true, "[N]       : %s unable to execute actions email err=%s", data.Username, err)
+				failed++
+				continue
+			}
+		}
+
+		if err := markNotified(ctx, client, token.AccessToken, targetRealm, user, time.Now()); err != nil {
+			// The email has gone, so report loudly that the user may be emailed again.
+			output(ERROR, true, true, "[N]       : %s notified but unable to record %s err=%s", data.Username, *notifyAttribute, err)
+			failed++
+			continue
+		}
+		output(INFO, true, false, "[N]       : %s <%s> notified of deletion on %s", data.Username, data.Email, data.DeletionDate)
+		notified++
+	}
+
+	output(INFO, true, true, "[N]       : candidates=%d notified=%d alreadyNotified=%d failed=%d out of %d%s", candidates, notified, alreadyNotified, failed, len(users), STRING_USERS_SEARCHED)
+	output(INFO, true, true, "[N][END]  : Notify users ********")
+}
+
+// hasBeenNotified returns true if the user carries the notification attribute.
+func hasBeenNotified(user *gocloak.User) bool {
+	if user.Attributes == nil {
+		return false
+	}
+	values, ok := (*user.Attributes)[*notifyAttribute]
+	return ok && len(values) > 0 && strings.TrimSpace(values[0]) != ""
+}
+
+// notifiedDaysAgo returns true if the user was notified at least `days` days before now, so has had
+// the full warning period. A notification date that can not be read does not count.
+func notifiedDaysAgo(user *gocloak.User, days int, now time.Time) bool {
+	if !hasBeenNotified(user) {
+		return false
+	}
+	notified, err := time.Parse(DateFormat, strings.TrimSpace((*user.Attributes)[*notifyAttribute][0]))
+	if err != nil {
+		return false
+	}
+	return !notified.AddDate(0, 0, days).After(now)
+}
+
+// deletionDateFor works out the date the user will cross the cutoff, based on how far the cutoff
+// currently sits behind now. Users already past the cutoff are due today.
+func deletionDateFor(createdTimestamp int64, deleteEpochTime int64, now int64) string {
+	due := createdTimestamp + (now - deleteEpochTime)
+	if due < now {
+		due = now
+	}
+	return epochToDateString(due)
+}
+
+func loadNotifyTemplate(path string) (*template.Template, error) {
+	text := defaultNotifyTemplate
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+	return template.New("notify").Option("missingkey=error").Parse(text)
+}
+
+func renderNotifyTemplate(tmpl *template.Template, data notifyData) (string, error) {
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return "", err
+	}
+	return body.String(), nil
+}
+
+func sendNotifySMTP(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if *smtpUsername != "" {
+		auth = smtp.PlainAuth("", *smtpUsername, *smtpPassword, *smtpHost)
+	}
+	message := "From: " + *smtpFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(*smtpHost+":"+strconv.Itoa(*smtpPort), auth, *smtpFrom, []string{to}, []byte(message))
+}
+
+func sendNotifyKeycloak(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, userID string) error {
+	actions := []string{}
+	for _, action := range strings.Split(*notifyActions, ",") {
+		if strings.TrimSpace(action) != "" {
+			actions = append(actions, strings.TrimSpace(action))
+		}
+	}
+	params := gocloak.ExecuteActionsEmail{
+		UserID:  &userID,
+		Actions: &actions,
+	}
+	if *notifyLifespan > 0 {
+		params.Lifespan = notifyLifespan
+	}
+	return client.ExecuteActionsEmail(ctx, accessToken, targetRealm, params)
+}
+
+// markNotified stamps the notification date onto the user, so they are never emailed twice.
+func markNotified(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, user *gocloak.User, when time.Time) error {
+	attributes := map[string][]string{}
+	if user.Attributes != nil {
+		attributes = *user.Attributes
+	}
+	attributes[*notifyAttribute] = []string{when.UTC().Format(DateFormat)}
+	user.Attributes = &attributes
+	if err := client.UpdateUser(ctx, accessToken, targetRealm, *user); err != nil {
+		return fmt.Errorf("update user %s: %w", gocloak.PString(user.ID), err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func TestDeletionDateFor(t *testing.T) {
+	// 2022-01-01 00:00:00 UTC, with a cutoff 30 days earlier.
+	now := int64(1640995200000)
+	cutoff := now - 30*millisecondsInDay
+
+	// created 5 days after the cutoff, so due in 5 days.
+	got := deletionDateFor(cutoff+5*millisecondsInDay, cutoff, now)
+	if got != "2022-01-06" {
+		t.Errorf("got %q, wanted %q", got, "2022-01-06")
+	}
+
+	// already past the cutoff, so due today.
+	got = deletionDateFor(cutoff-millisecondsInDay, cutoff, now)
+	if got != "2022-01-01" {
+		t.Errorf("got %q, wanted %q", got, "2022-01-01")
+	}
+}
+
+func TestHasBeenNotified(t *testing.T) {
+	user := &gocloak.User{}
+	if hasBeenNotified(user) {
+		t.Errorf("user without attributes should not be notified")
+	}
+
+	attributes := map[string][]string{*notifyAttribute: {"2022-01-01"}}
+	user.Attributes = &attributes
+	if !hasBeenNotified(user) {
+		t.Errorf("user with %s should be notified", *notifyAttribute)
+	}
+}
+
+func TestNotifiedDaysAgo(t *testing.T) {
+	now := time.Date(2022, 1, 15, 10, 0, 0, 0, time.UTC)
+	user := &gocloak.User{}
+	if notifiedDaysAgo(user, 14, now) {
+		t.Errorf("user without attributes should not be notified")
+	}
+
+	for notified, expected := range map[string]bool{"2022-01-01": true, "2022-01-02": false, "2022-01-15": false, "not a date": false} {
+		attributes := map[string][]string{*notifyAttribute: {notified}}
+		user.Attributes = &attributes
+		if got := notifiedDaysAgo(user, 14, now); got != expected {
+			t.Errorf("notifiedDaysAgo(%s) = %v, wanted %v", notified, got, expected)
+		}
+	}
+}
+
+func TestRenderNotifyTemplate(t *testing.T) {
+	tmpl, err := loadNotifyTemplate("")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	body, err := renderNotifyTemplate(tmpl, notifyData{Username: "testUser", Realm: "delete", DeletionDate: "2022-01-06"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(body, `"testUser" in delete`) || !strings.Contains(body, "2022-01-06") {
+		t.Errorf("unexpected body %q", body)
+	}
+}
@@ -15,7 +15,7 @@ const (
 )
 
 func output(logLevel LogLevel, logFlag bool, printFlag bool, format string, a ...interface{}) {
-	message := fmt.Sprintf(format, a...)
+	message := redact(fmt.Sprintf(format, a...))
 	switch logLevel {
 	case INFO:
 		if logFlag {
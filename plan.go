@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The plan file format version, bumped whenever the hashed content changes.
+const planVersion = 1
+
+// The criteria the plan was generated with, recorded for the reviewer.
+type planCriteria struct {
+	Days       int    `json:"days"`
+	DeleteDate string `json:"deleteDate,omitempty"`
+	SearchMin  int    `json:"searchMin"`
+	SearchMax  int    `json:"searchMax"`
+}
+
+// deletionPlan is the immutable artifact produced by `--plan` and executed by `--apply`.
+type deletionPlan struct {
+	Version    int          `json:"version"`
+	RunID      string       `json:"runId"`
+	CreatedAt  string       `json:"createdAt"`
+	CreatedBy  string       `json:"createdBy"`
+	URL        string       `json:"url"`
+	Realm      string       `json:"realm"`
+	Cutoff     int64        `json:"cutoff"`
+	CutoffDate string       `json:"cutoffDate"`
+	Criteria   planCriteria `json:"criteria"`
+	Users      []userJob    `json:"users"`
+	// The approvals required, and who from, are set when the plan is created, and signed by the author.
+	RequiredApprovals int            `json:"requiredApprovals,omitempty"`
+	Approvers         []planApprover `json:"approvers,omitempty"`
+	Hash              string         `json:"hash"`
+	// The author's signature and the approvals sign the hash, so they are not part of it.
+	Author    *planApproval  `json:"author,omitempty"`
+	Approvals []planApproval `json:"approvals,omitempty"`
+}
+
+// contentHash is the sha256 of everything in the plan, except the hash itself and the signatures.
+func (p deletionPlan) contentHash() string {
+	p.Hash = ""
+	p.Author = nil
+	p.Approvals = nil
+	data, err := json.Marshal(p)
+	if err != nil {
+		// Only plain values are marshalled, so this can't happen.
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// checkTarget refuses to apply a plan generated against another server or realm.
+func (p *deletionPlan) checkTarget(url string, realm string) error {
+	if p.URL != url {
+		return fmt.Errorf("plan is for url=%s, not %s", p.URL, url)
+	}
+	if p.Realm != realm {
+		return fmt.Errorf("plan is for realm=%s, not %s", p.Realm, realm)
+	}
+	return nil
+}
+
+// writePlan writes the plan, encrypted like the list files when `--encryptTo` is set, as it lists the
+// users.
+func writePlan(path string, plan *deletionPlan) error {
+	plan.Hash = plan.contentHash()
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeOutputFile(path, append(data, '\n'))
+}
+
+// readPlan reads a plan, decrypting it with the `identityFile` if it is encrypted, and checks that it
+// has not been modified since it was generated.
+func readPlan(path string) (*deletionPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(ageHeader)) {
+		identities, err := loadIdentities(*identityFile)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = decryptBytes(data, identities); err != nil {
+			return nil, err
+		}
+	}
+	var plan deletionPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, err
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("plan version=%d is not supported", plan.Version)
+	}
+	if plan.Hash != plan.contentHash() {
+		return nil, fmt.Errorf("plan hash does not match its content, it has been modified")
+	}
+	return &plan, nil
+}
+
+// verifyPlan checks the plan is for this url and realm, and has been approved by `required` trusted
+// approvers from the `approversFile`, or as many as the plan requires, if more. Only the approvers
+// recorded in the plan count.
+func verifyPlan(plan *deletionPlan, url string, realm string, required int) error {
+	if err := plan.checkTarget(url, realm); err != nil {
+		return err
+	}
+	// The approvals the plan requires are covered by the author's signature, so a signed plan is
+	// always checked, even when no approvals are required here.
+	if plan.Author != nil && !plan.Author.verify(plan.Hash) {
+		return fmt.Errorf("plan author %s signature does not match the plan", plan.Author.Approver)
+	}
+	if plan.RequiredApprovals > required {
+		required = plan.RequiredApprovals
+	}
+	if required == 0 {
+		return nil
+	}
+	trusted, err := trustedApprovers(required)
+	if err != nil {
+		return err
+	}
+	return verifyApprovals(plan, plan.recordedApprovers(trusted), required)
+}
+
+// createPlan finds the users that would be deleted, and writes them to the plan file for review.
+func createPlan(realmName string, clientId string, clientSecret string, targetRealm string, url string, deleteEpochTime int64, createdBy string, path string) {
+	output(INFO, true, true, "[P][START]: Create plan ********")
+
+	validate := false
+	client, token, err := login(realmName, clientId, clientSecret, url, *headerKey, *headerValue, loginAsAdmin, &validate)
+	if err != nil {
+		output(ERROR, true, true, "[P]       : login failed err=%s", err)
+		return
+	}
+	candidates, searched, err := findCandidates(context.Background(), client, token.AccessToken, targetRealm, deleteEpochTime)
+	if err != nil {
+		output(ERROR, true, true, "[P]       : Error fetching users: %s", err)
+		return
+	}
+
+	plan := &deletionPlan{
+		Version:    planVersion,
+		RunID:      runId,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+		CreatedBy:  createdBy,
+		URL:        url,
+		Realm:      targetRealm,
+		Cutoff:     deleteEpochTime,
+		CutoffDate: epochToDateString(deleteEpochTime),
+		Criteria: planCriteria{
+			Days:       *maxAgeInDays,
+			DeleteDate: *deleteDate,
+			SearchMin:  *searchMin,
+			SearchMax:  *searchMax,
+		},
+		Users: candidates,
+	}
+	if err := requireApprovals(plan, approvalsRequired()); err != nil {
+		output(ERROR, true, true, "[P]       : %s", err)
+		return
+	}
+	// The author signs the plan, so the approvers can be checked against who actually created it.
+	if *signingKey != "" {
+		key, err := loadSigningKey(*signingKey)
+		if err != nil {
+			output(ERROR, true, true, "[P]       : unable to read signingKey=%s err=%s", *signingKey, err)
+			return
+		}
+		plan.Hash = plan.contentHash()
+		plan.Author = newPlanSignature(plan, createdBy, key, time.Now())
+	}
+	if err := writePlan(path, plan); err != nil {
+		output(ERROR, true, true, "[P]       : unable to write plan=%s err=%s", path, err)
+		return
+	}
+
+	output(INFO, true, true, "[P]       : %d users out of %d%s planned for deletion, olderThan=%s", len(candidates), searched, STRING_USERS_SEARCHED, plan.CutoffDate)
+	output(INFO, true, true, "[P]       : plan=%s hash=%s", path, plan.Hash)
+	output(INFO, true, true, "[P][END]  : Create plan ********")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func testPlan() *deletionPlan {
+	return &deletionPlan{
+		Version: planVersion,
+		RunID:   "1",
+		URL:     "http://127.0.0.1:8080",
+		Realm:   "delete",
+		Cutoff:  1640995200000,
+		Users:   []userJob{{ID: "a1", Username: "userA", CreatedTimestamp: 1640995100000}},
+	}
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := writePlan(path, testPlan()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	plan, err := readPlan(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(plan.Users) != 1 || plan.Users[0] != testPlan().Users[0] {
+		t.Errorf("got %v", plan.Users)
+	}
+
+	// Any change to the content invalidates the hash.
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(data), "userA", "userB", 1)), 0600)
+	if _, err := readPlan(path); err == nil {
+		t.Errorf("expected an error for a modified plan")
+	}
+}
+
+func TestEncryptedPlan(t *testing.T) {
+	dir := t.TempDir()
+	savedIdentity := *identityFile
+	defer func() { *identityFile, outputRecipients = savedIdentity, nil }()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	*identityFile = filepath.Join(dir, "key.txt")
+	os.WriteFile(*identityFile, []byte(identity.String()+"\n"), 0600)
+	outputRecipients = []age.Recipient{identity.Recipient()}
+
+	path := filepath.Join(dir, "plan.json")
+	if err := writePlan(path, testPlan()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), "userA") {
+		t.Errorf("plan is not encrypted")
+	}
+	plan, err := readPlan(path)
+	if err != nil || len(plan.Users) != 1 || plan.Users[0] != testPlan().Users[0] {
+		t.Fatalf("plan=%+v err=%v", plan, err)
+	}
+
+	// Approving writes the plan back, so it needs the recipients to keep it encrypted.
+	key := filepath.Join(dir, "bob.pem")
+	if _, err := generateSigningKey(key, "bob"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	outputRecipients = nil
+	if err := approvePlan(path, "bob", key); err == nil {
+		t.Errorf("expected an encrypted plan not to be approved without --encryptTo")
+	}
+	outputRecipients = []age.Recipient{identity.Recipient()}
+	if err := approvePlan(path, "bob", key); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	raw, _ = os.ReadFile(path)
+	if plan, err := readPlan(path); err != nil || len(plan.Approvals) != 1 || strings.Contains(string(raw), "userA") {
+		t.Errorf("plan=%+v err=%v, wanted the approved plan still encrypted", plan, err)
+	}
+}
+
+func TestPlanCheckTarget(t *testing.T) {
+	plan := testPlan()
+	if err := plan.checkTarget("http://127.0.0.1:8080", "delete"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := plan.checkTarget("http://127.0.0.1:8080", "master"); err == nil {
+		t.Errorf("expected an error for another realm")
+	}
+	if err := plan.checkTarget("https://prod.example.com", "delete"); err == nil {
+		t.Errorf("expected an error for another url")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Nerzal/gocloak/v13"
+	"gopkg.in/yaml.v3"
+)
+
+// The actions a retention policy can take on its candidates.
+const (
+	POLICY_ACTION_DELETE = "delete"
+	POLICY_ACTION_REPORT = "report"
+)
+
+// policyMatch chooses the users a policy applies to. Every condition that is set has to match.
+type policyMatch struct {
+	Username      string            `yaml:"username"`
+	EmailVerified *bool             `yaml:"emailVerified"`
+	Enabled       *bool             `yaml:"enabled"`
+	Attributes    map[string]string `yaml:"attributes"`
+	Group         string            `yaml:"group"`
+
+	usernamePattern *regexp.Regexp
+	members         map[string]bool
+}
+
+// retentionPolicy is a named rule from the `policyFile`. A user belongs to the first policy that
+// matches it, and is a candidate when it was created on or before that policy's cutoff.
+type retentionPolicy struct {
+	Name             string      `yaml:"name"`
+	Match            policyMatch `yaml:"match"`
+	Days             *int        `yaml:"days"`
+	DeleteDate       string      `yaml:"deleteDate"`
+	Action           string      `yaml:"action"`
+	MaxDeletes       int         `yaml:"maxDeletes"`
+	MaxDeletePercent float64     `yaml:"maxDeletePercent"`
+	Limit            int         `yaml:"limit"`
+
+	cutoff   int64
+	counters policyCounters
+}
+
+// policyCounters are updated by the workers, so are only accessed atomically.
+type policyCounters struct {
+	matched    int32
+	candidates int32
+	deleted    int32
+	skipped    int32
+	failed     int32
+	dryRun     int32
+}
+
+type policyDocument struct {
+	Policies []*retentionPolicy `yaml:"policies"`
+}
+
+// policies are the retention policies of this run, in the order they are evaluated.
+var policies []*retentionPolicy
+
+// readPolicies reads and checks the policy file, working out each policy's cutoff.
+func readPolicies(path string) ([]*retentionPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file policyDocument
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Policies) == 0 {
+		return nil, fmt.Errorf("%s has no policies", path)
+	}
+	names := map[string]bool{}
+	for i, policy := range file.Policies {
+		if policy.Name == "" {
+			return nil, fmt.Errorf("policy %d has no name", i+1)
+		}
+		if names[policy.Name] {
+			return nil, fmt.Errorf("policy %s is defined twice", policy.Name)
+		}
+		names[policy.Name] = true
+
+		switch {
+		case policy.Days != nil && policy.DeleteDate != "":
+			return nil, fmt.Errorf("policy %s has both days and deleteDate", policy.Name)
+		case policy.Days != nil:
+			policy.cutoff = daysToEpoch(*policy.Days)
+		case policy.DeleteDate != "":
+			if policy.cutoff, err = parseDateToEpoch(policy.DeleteDate); err != nil {
+				return nil, fmt.Errorf("policy %s: %w", policy.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("policy %s has neither days nor deleteDate", policy.Name)
+		}
+
+		if policy.Action == "" {
+			policy.Action = POLICY_ACTION_DELETE
+		}
+		if policy.Action != POLICY_ACTION_DELETE && policy.Action != POLICY_ACTION_REPORT {
+			return nil, fmt.Errorf("policy %s action=%s is not delete or report", policy.Name, policy.Action)
+		}
+		if policy.Match.Username != "" {
+			if policy.Match.usernamePattern, err = regexp.Compile(policy.Match.Username); err != nil {
+				return nil, fmt.Errorf("policy %s: %w", policy.Name, err)
+			}
+		}
+	}
+	return file.Policies, nil
+}
+
+// loadGroupMembers fetches the members of the groups the policies match on.
+func loadGroupMembers(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, policies []*retentionPolicy) error {
+	for _, policy := range policies {
+		if policy.Match.Group == "" {
+			continue
+		}
+		group, err := client.GetGroupByPath(ctx, accessToken, targetRealm, policy.Match.Group)
+		if err != nil {
+			return fmt.Errorf("policy %s group=%s: %w", policy.Name, policy.Match.Group, err)
+		}
+		if policy.Match.members, err = groupMembers(ctx, client, accessToken, targetRealm, *group.ID); err != nil {
+			return fmt.Errorf("policy %s group=%s: %w", policy.Name, policy.Match.Group, err)
+		}
+	}
+	return nil
+}
+
+// groupMembers returns the ids of the group's members.
+func groupMembers(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, groupID string) (map[string]bool, error) {
+	members := map[string]bool{}
+	const pageSize = 100
+	for first := 0; ; first += pageSize {
+		page, err := client.GetGroupMembers(ctx, accessToken, targetRealm, groupID, gocloak.GetGroupsParams{First: gocloak.IntP(first), Max: gocloak.IntP(pageSize)})
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range page {
+			members[*member.ID] = true
+		}
+		if len(page) < pageSize {
+			return members, nil
+		}
+	}
+}
+
+func (m *policyMatch) matches(user *gocloak.User) bool {
+	if m.usernamePattern != nil && (user.Username == nil || !m.usernamePattern.MatchString(*user.Username)) {
+		return false
+	}
+	if m.EmailVerified != nil && (user.EmailVerified == nil || *user.EmailVerified != *m.EmailVerified) {
+		return false
+	}
+	if m.Enabled != nil && (user.Enabled == nil || *user.Enabled != *m.Enabled) {
+		return false
+	}
+	for key, want := range m.Attributes {
+		if !hasAttributeValue(user, key, want) {
+			return false
+		}
+	}
+	if m.Group != "" && (user.ID == nil || !m.members[*user.ID]) {
+		return false
+	}
+	return true
+}
+
+func hasAttributeValue(user *gocloak.User, key string, want string) bool {
+	if user.Attributes == nil {
+		return false
+	}
+	for _, value := range (*user.Attributes)[key] {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFor returns the first policy that matches the user.
+func policyFor(policies []*retentionPolicy, user *gocloak.User) *retentionPolicy {
+	for _, policy := range policies {
+		if policy.Match.matches(user) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// selectByPolicy attributes each user to the first matching policy, and selects it when it is older
+// than that policy's cutoff.
+func selectByPolicy(policies []*retentionPolicy) userSelector {
+	return func(user *gocloak.User) (userJob, bool) {
+		policy := policyFor(policies, user)
+		if policy == nil {
+			return userJob{}, false
+		}
+		atomic.AddInt32(&policy.counters.matched, 1)
+		if user.CreatedTimestamp == nil || *user.CreatedTimestamp > policy.cutoff {
+			return userJob{}, false
+		}
+		atomic.AddInt32(&policy.counters.candidates, 1)
+		return userJob{ID: *user.ID, Username: *user.Username, CreatedTimestamp: *user.CreatedTimestamp, Policy: policy.Name}, true
+	}
+}
+
+// applyPolicies applies each policy's action and limit, then checks its deletion limits. Users of
+// `report` policies are listed but not deleted. When override is set, exceeding a policy's limits
+// only warns.
+func applyPolicies(policies []*retentionPolicy, candidates []userJob, totalUsers int, override bool) ([]userJob, error) {
+	byPolicy := groupByPolicy(candidates)
+	var selected []userJob
+	for _, policy := range policies {
+		if policy.Action == POLICY_ACTION_REPORT {
+			continue
+		}
+		users, _ := limitCandidates(byPolicy[policy.Name], policy.Limit)
+		if err := checkDeletionLimits(len(users), totalUsers, policy.MaxDeletes, policy.MaxDeletePercent); err != nil {
+			if !override {
+				return nil, fmt.Errorf("policy %s: %w", policy.Name, err)
+			}
+			output(WARNING, true, true, "[Y]       : policy=%s %s, overridden by --overrideLimits", policy.Name, err)
+		}
+		selected = append(selected, users...)
+	}
+	sortOldestFirst(selected)
+	return selected, nil
+}
+
+func groupByPolicy(users []userJob) map[string][]userJob {
+	byPolicy := map[string][]userJob{}
+	for _, user := range users {
+		byPolicy[user.Policy] = append(byPolicy[user.Policy], user)
+	}
+	for _, users := range byPolicy {
+		sortOldestFirst(users)
+	}
+	return byPolicy
+}
+
+// printPolicyCandidates lists the candidates grouped by policy, in policy order.
+func printPolicyCandidates(policies []*retentionPolicy, candidates []userJob) {
+	byPolicy := groupByPolicy(candidates)
+	for _, policy := range policies {
+		users := byPolicy[policy.Name]
+		output(INFO, true, true, "[Y]       : policy=%s action=%s olderThan=%s matched=%d candidates=%d", policy.Name, policy.Action, epochToDateString(policy.cutoff), atomic.LoadInt32(&policy.counters.matched), len(users))
+		if !printUsers() {
+			continue
+		}
+		for _, user := range users {
+			output(INFO, true, true, "[Y]       :   %s,%s,%s", user.Username, user.ID, epochToDateString(user.CreatedTimestamp))
+		}
+	}
+}
+
+// writePolicyList writes the candidates, with their policy, to the `listFile`.
+func writePolicyList(candidates []userJob) {
+	if *listFile == "" {
+		return
+	}
+	var list strings.Builder
+	list.WriteString("Username,ID,Policy\n")
+	for _, user := range candidates {
+		list.WriteString(user.Username + "," + user.ID + "," + user.Policy + "\n")
+	}
+	if err := writeOutputFile(*listFile, []byte(list.String())); err != nil {
+		output(ERROR, true, true, "[Y]       : Error writing listFile: %s", err)
+		return
+	}
+	output(INFO, true, true, "[Y]       : listFile=%s encrypted=%t", *listFile, len(outputRecipients) > 0)
+}
+
+// countPolicyOutcome adds the outcome of processing the user to its policy's counters.
+func countPolicyOutcome(job userJob, outcome string) {
+	if job.Policy == "" {
+		return
+	}
+	for _, policy := range policies {
+		if policy.Name != job.Policy {
+			continue
+		}
+		switch outcome {
+		case OUTCOME_DELETED:
+			atomic.AddInt32(&policy.counters.deleted, 1)
+		case OUTCOME_DRY_RUN:
+			atomic.AddInt32(&policy.counters.dryRun, 1)
+		case OUTCOME_FAILED:
+			atomic.AddInt32(&policy.counters.failed, 1)
+		default:
+			atomic.AddInt32(&policy.counters.skipped, 1)
+		}
+	}
+}
+
+// policySummary returns a line per policy, with its counters.
+func policySummary(policies []*retentionPolicy) []string {
+	var lines []string
+	for _, policy := range policies {
+		c := &policy.counters
+		lines = append(lines, "policy="+policy.Name+" action="+policy.Action+
+			" matched="+strconv.Itoa(int(atomic.LoadInt32(&c.matched)))+
+			" candidates="+strconv.Itoa(int(atomic.LoadInt32(&c.candidates)))+
+			" deleted="+strconv.Itoa(int(atomic.LoadInt32(&c.deleted)))+
+			" dryRun="+strconv.Itoa(int(atomic.LoadInt32(&c.dryRun)))+
+			" skipped="+strconv.Itoa(int(atomic.LoadInt32(&c.skipped)))+
+			" failed="+strconv.Itoa(int(atomic.LoadInt32(&c.failed))))
+	}
+	return lines
+}
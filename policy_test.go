@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func testPolicyUser(id string, created int64, emailVerified bool, attributes map[string][]string) *gocloak.User {
+	return &gocloak.User{
+		ID:               gocloak.StringP(id),
+		Username:         gocloak.StringP("user-" + id),
+		CreatedTimestamp: gocloak.Int64P(created),
+		EmailVerified:    gocloak.BoolP(emailVerified),
+		Attributes:       &attributes,
+	}
+}
+
+func TestReadPolicies(t *testing.T) {
+	// The cutoff is relative to now, so it is between the cutoffs before and after reading.
+	earliest := daysToEpoch(7)
+	got, err := readPolicies("policies.example.yaml")
+	latest := daysToEpoch(7)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(got) != 4 || got[0].Name != "guests" || got[0].Action != POLICY_ACTION_DELETE || got[3].Action != POLICY_ACTION_REPORT {
+		t.Errorf("policies=%+v", got)
+	}
+	if got[0].cutoff < earliest || got[0].cutoff > latest {
+		t.Errorf("cutoff=%d, want %d", got[0].cutoff, earliest)
+	}
+
+	for _, invalid := range []string{
+		"policies: []\n",
+		"policies:\n  - days: 7\n",
+		"policies:\n  - name: a\n",
+		"policies:\n  - name: a\n    days: 7\n    deleteDate: 2020-01-01\n",
+		"policies:\n  - name: a\n    days: 7\n  - name: a\n    days: 8\n",
+		"policies:\n  - name: a\n    days: 7\n    action: archive\n",
+		"policies:\n  - name: a\n    days: 7\n    match:\n      username: \"[\"\n",
+	} {
+		path := filepath.Join(t.TempDir(), "policies.yaml")
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPolicies(path); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestSelectByPolicy(t *testing.T) {
+	days7, days30 := 7, 30
+	trial := &retentionPolicy{Name: "trials", Days: &days7, cutoff: 1000, Match: policyMatch{Attributes: map[string]string{"plan": "trial"}}}
+	unverified := &retentionPolicy{Name: "unverified", Days: &days30, cutoff: 500, Match: policyMatch{EmailVerified: gocloak.BoolP(false)}}
+	all := []*retentionPolicy{trial, unverified}
+	selected := selectByPolicy(all)
+
+	// An unverified trial user belongs to trials, the first policy it matches.
+	job, ok := selected(testPolicyUser("a", 900, false, map[string][]string{"plan": {"trial"}}))
+	if !ok || job.Policy != "trials" {
+		t.Errorf("job=%+v ok=%t, want trials", job, ok)
+	}
+	// It is too new for unverified's cutoff, but it still belongs to trials, so is not selected
+	// by the later policy either.
+	if _, ok := selected(testPolicyUser("b", 1100, false, map[string][]string{"plan": {"trial"}})); ok {
+		t.Errorf("expected a user newer than its policy's cutoff not to be selected")
+	}
+	job, ok = selected(testPolicyUser("c", 400, false, nil))
+	if !ok || job.Policy != "unverified" {
+		t.Errorf("job=%+v ok=%t, want unverified", job, ok)
+	}
+	if _, ok := selected(testPolicyUser("d", 100, true, nil)); ok {
+		t.Errorf("expected a user matching no policy not to be selected")
+	}
+
+	if trial.counters.matched != 2 || trial.counters.candidates != 1 || unverified.counters.matched != 1 || unverified.counters.candidates != 1 {
+		t.Errorf("trial=%+v unverified=%+v", trial.counters, unverified.counters)
+	}
+}
+
+func TestApplyPolicies(t *testing.T) {
+	guests := &retentionPolicy{Name: "guests", Action: POLICY_ACTION_DELETE, Limit: 2}
+	report := &retentionPolicy{Name: "everyone", Action: POLICY_ACTION_REPORT}
+	candidates := []userJob{
+		{ID: "g3", Policy: "guests", CreatedTimestamp: 300},
+		{ID: "g1", Policy: "guests", CreatedTimestamp: 100},
+		{ID: "e1", Policy: "everyone", CreatedTimestamp: 50},
+		{ID: "g2", Policy: "guests", CreatedTimestamp: 200},
+	}
+
+	got, err := applyPolicies([]*retentionPolicy{guests, report}, candidates, 100, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The report policy's user is not deleted, and guests is limited to its 2 oldest.
+	if len(got) != 2 || got[0].ID != "g1" || got[1].ID != "g2" {
+		t.Errorf("got %+v", got)
+	}
+
+	guests.MaxDeletes = 1
+	if _, err := applyPolicies([]*retentionPolicy{guests, report}, candidates, 100, false); err == nil {
+		t.Errorf("expected an error when a policy exceeds maxDeletes")
+	}
+	if got, err := applyPolicies([]*retentionPolicy{guests, report}, candidates, 100, true); err != nil || len(got) != 2 {
+		t.Errorf("got %+v err=%v, wanted the limit overridden", got, err)
+	}
+}
+
+func TestWritePolicyList(t *testing.T) {
+	saved := *listFile
+	defer func() { *listFile = saved }()
+	*listFile = filepath.Join(t.TempDir(), "candidates.csv")
+
+	writePolicyList([]userJob{{ID: "a1", Username: "userA", Policy: "guests"}})
+	data, err := os.ReadFile(*listFile)
+	if err != nil || string(data) != "Username,ID,Policy\nuserA,a1,guests\n" {
+		t.Errorf("listFile=%q err=%v", data, err)
+	}
+	// The list can be fed back in with --fromFile.
+	users, err := parseUserList(strings.NewReader(string(data)))
+	if err != nil || len(users) != 1 || users[0].ID != "a1" {
+		t.Errorf("users=%v err=%v", users, err)
+	}
+}
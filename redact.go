@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// MASK replaces a secret in the output.
+const MASK = "********"
+
+// minSecretLength is the shortest secret redacted wherever it appears. Shorter ones, such as the
+// default `admin`, would also hide ordinary words, so they are only masked where they are printed.
+const minSecretLength = 8
+
+// secrets holds the secret values to redact from the output.
+var secrets = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+// addSecret redacts the value from everything written by output and the log from now on.
+func addSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, known := range secrets.values {
+		if known == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+	// Longest first, so a secret containing another is replaced whole.
+	sort.Slice(secrets.values, func(i, j int) bool { return len(secrets.values[i]) > len(secrets.values[j]) })
+}
+
+// redact replaces the secrets in the text, unless `--revealSecrets` is set.
+func redact(text string) string {
+	if *revealSecrets {
+		return text
+	}
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, secret := range secrets.values {
+		text = strings.ReplaceAll(text, secret, MASK)
+	}
+	return text
+}
+
+// maskSecret returns the value to print for a secret option, showing only whether it is set.
+func maskSecret(value string) string {
+	if value == "" || *revealSecrets {
+		return value
+	}
+	return MASK
+}
+
+// addToken redacts the token's access, refresh and id tokens from the output.
+func addToken(token *gocloak.JWT) {
+	if token == nil {
+		return
+	}
+	addSecret(token.AccessToken)
+	addSecret(token.RefreshToken)
+	addSecret(token.IDToken)
+}
+
+// describeToken returns the token to print, without the tokens themselves.
+func describeToken(token *gocloak.JWT) string {
+	if token == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("type=%s expiresIn=%d refreshExpiresIn=%d scope=%s accessToken=%s refreshToken=%s",
+		token.TokenType, token.ExpiresIn, token.RefreshExpiresIn, token.Scope, maskSecret(token.AccessToken), maskSecret(token.RefreshToken))
+}
+
+// redactingWriter redacts the secrets from everything written to the log.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
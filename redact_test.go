@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func TestRedact(t *testing.T) {
+	addSecret("s3cret-value")
+	addSecret("s3cret-value-longer")
+	addSecret("admin")
+	got := redact("secret=s3cret-value longer=s3cret-value-longer clientId=admin")
+	if want := "secret=" + MASK + " longer=" + MASK + " clientId=admin"; got != want {
+		t.Errorf("redact=%s, want %s", got, want)
+	}
+
+	*revealSecrets = true
+	defer func() { *revealSecrets = false }()
+	if got := redact("secret=s3cret-value"); got != "secret=s3cret-value" {
+		t.Errorf("redact=%s, wanted the secret with revealSecrets", got)
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	addSecret("header-api-key")
+	var buf bytes.Buffer
+	line := "X-Api-Key: header-api-key\n"
+	n, err := redactingWriter{&buf}.Write([]byte(line))
+	if err != nil || n != len(line) {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if strings.Contains(buf.String(), "header-api-key") {
+		t.Errorf("log=%s, wanted the secret redacted", buf.String())
+	}
+}
+
+func TestDescribeToken(t *testing.T) {
+	token := &gocloak.JWT{AccessToken: "eyJhbGciOi.access", RefreshToken: "eyJhbGciOi.refresh", ExpiresIn: 60, TokenType: "Bearer"}
+	got := describeToken(token)
+	if strings.Contains(got, "eyJ") || !strings.Contains(got, "expiresIn=60") {
+		t.Errorf("describeToken=%s", got)
+	}
+	if maskSecret("") != "" {
+		t.Errorf("expected an unset secret to stay empty")
+	}
+}
+
+func TestRedactingWriterHidesTokens(t *testing.T) {
+	token := &gocloak.JWT{AccessToken: "eyJhbGciOiJSUzI1NiJ9.access.signature", RefreshToken: "eyJhbGciOiJIUzI1NiJ9.refresh.signature"}
+	addToken(token)
+	var buf bytes.Buffer
+	logger := log.New(redactingWriter{&buf}, "", 0)
+	logger.Println("refresh token success", token.AccessToken, token)
+	if strings.Contains(buf.String(), token.AccessToken) || strings.Contains(buf.String(), token.RefreshToken) {
+		t.Errorf("log=%s, wanted the tokens redacted", buf.String())
+	}
+}
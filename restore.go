@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// readBackupFile reads every record from an NDJSON backup file, decrypting encrypted records with
+// the given identities.
+func readBackupFile(path string, identities []age.Identity) ([]backupRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readBackupRecords(file, identities)
+}
+
+func readBackupRecords(in io.Reader, identities []age.Identity) ([]backupRecord, error) {
+	var records []backupRecord
+	scanner := bufio.NewScanner(in)
+	// A user with many attributes can easily exceed the default 64k line limit.
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		text := scanner.Bytes()
+		if isEncryptedLine(text) {
+			plain, err := decryptLine(bytes.TrimSpace(text), identities)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			text = plain
+		}
+		var record backupRecord
+		if err := json.Unmarshal(text, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if record.User == nil {
+			return nil, fmt.Errorf("line %d: no user in backup record", line)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// filterBackupRecords keeps the records from the given run, whose username or id is in the given
+// comma separated list. An empty run id or list matches everything.
+func filterBackupRecords(records []backupRecord, filterRunId string, usersList string) []backupRecord {
+	wanted := map[string]bool{}
+	for _, entry := range strings.Split(usersList, ",") {
+		if strings.TrimSpace(entry) != "" {
+			wanted[strings.TrimSpace(entry)] = true
+		}
+	}
+	var filtered []backupRecord
+	for _, record := range records {
+		if filterRunId != "" && record.RunID != filterRunId {
+			continue
+		}
+		if len(wanted) > 0 && !wanted[gocloak.PString(record.User.Username)] && !wanted[gocloak.PString(record.User.ID)] {
+			continue
+		}
+		filtered = append(filtered, record)
+	}
+	return filtered
+}
+
+// restoreUsersFromBackup recreates the users in the backup file, along with their groups, role
+// mappings and identity provider links.
+func restoreUsersFromBackup(realmName string, clientId string, clientSecret string, url string, path string) {
+	output(INFO, true, true, "[U][START]: Restore users ********")
+
+	identities, err := loadIdentities(*identityFile)
+	if err != nil {
+		output(ERROR, true, true, "[U]       : unable to read identityFile=%s err=%s", *identityFile, err)
+		return
+	}
+	records, err := readBackupFile(path, identities)
+	if err != nil {
+		output(ERROR, true, true, "[U]       : unable to read backup=%s err=%s", path, err)
+		return
+	}
+	records = filterBackupRecords(records, *restoreRunId, *restoreUsers)
+	output(INFO, true, true, "[U]       : %d users selected from backup=%s", len(records), path)
+
+	validate := false
+	client, token, err := login(realmName, clientId, clientSecret, url, *headerKey, *headerValue, loginAsAdmin, &validate)
+	if err != nil {
+		output(ERROR, true, true, "[U]       : login failed err=%s", err)
+		return
+	}
+	ctx := context.Background()
+
+	var restored, existing, incomplete, failed int
+	for _, record := range records {
+		username := gocloak.PString(record.User.Username)
+
+		found, err := client.GetUsers(ctx, token.AccessToken, record.Realm, gocloak.GetUsersParams{Username: &username, Exact: gocloak.BoolP(true)})
+		if err != nil {
+			output(ERROR, true, true, "[U]       : %s unable to check for existing user err=%s", username, err)
+			failed++
+			continue
+		}
+		if len(found) > 0 {
+			output(WARNING, true, true, "[U]       : %s already exists in realm=%s, skipping", username, record.Realm)
+			existing++
+			continue
+		}
+
+		groupIds, realmRoles, clientRoles, missing := resolveUserAccess(ctx, client, token.AccessToken, record)
+		for _, m := range missing {
+			output(WARNING, true, true, "[U]       : %s %s no longer exists", username, m)
+		}
+
+		if *dryRun {
+			output(INFO, true, true, "[U]       : %s would be restored to realm=%s with %d groups, %d realm roles, %d client roles, %d identity links (dry run)", username, record.Realm, len(groupIds), len(realmRoles), len(clientRoles), len(record.FederatedIdentities))
+			restored++
+			if len(missing) > 0 {
+				incomplete++
+			}
+			continue
+		}
+
+		userID, err := client.CreateUser(ctx, token.AccessToken, record.Realm, restorableUser(record.User))
+		if err != nil {
+			output(ERROR, true, true, "[U]       : %s unable to create user err=%s", username, err)
+			failed++
+			continue
+		}
+
+		problems := len(missing)
+		for _, groupId := range groupIds {
+			if err := client.AddUserToGroup(ctx, token.AccessToken, record.Realm, userID, groupId); err != nil {
+				output(ERROR, true, true, "[U]       : %s unable to add group=%s err=%s", username, groupId, err)
+				problems++
+			}
+		}
+		if len(realmRoles) > 0 {
+			if err := client.AddRealmRoleToUser(ctx, token.AccessToken, record.Realm, userID, realmRoles); err != nil {
+				output(ERROR, true, true, "[U]       : %s unable to add realm roles err=%s", username, err)
+				problems++
+			}
+		}
+		for idOfClient, roles := range clientRoles {
+			if err := client.AddClientRolesToUser(ctx, token.AccessToken, record.Realm, idOfClient, userID, roles); err != nil {
+				output(ERROR, true, true, "[U]       : %s unable to add client roles client=%s err=%s", username, idOfClient, err)
+				problems++
+			}
+		}
+		for _, identity := range record.FederatedIdentities {
+			provider := gocloak.PString(identity.IdentityProvider)
+			if err := client.CreateUserFederatedIdentity(ctx, token.AccessToken, record.Realm, userID, provider, *identity); err != nil {
+				output(ERROR, true, true, "[U]       : %s unable to link identity provider=%s err=%s", username, provider, err)
+				problems++
+			}
+		}
+
+		output(INFO, true, true, "[U]       : %s restored as id=%s (was id=%s)", username, userID, gocloak.PString(record.User.ID))
+		restored++
+		if problems > 0 {
+			incomplete++
+		}
+	}
+
+	output(INFO, true, true, "[U]       : restored=%d incomplete=%d existing=%d failed=%d dryRun=%t", restored, incomplete, existing, failed, *dryRun)
+	output(INFO, true, true, "[U][END]  : Restore users ********")
+}
+
+// restorableUser strips the fields keycloak assigns itself, from the backed up user.
+func restorableUser(user *gocloak.User) gocloak.User {
+	restored := *user
+	restored.ID = nil
+	restored.CreatedTimestamp = nil
+	restored.Access = nil
+	restored.DisableableCredentialTypes = nil
+	restored.FederationLink = nil
+	restored.Totp = nil
+	return restored
+}
+
+// resolveUserAccess finds the current ids of the backed up groups and roles, which may have been
+// recreated since the backup. Anything that no longer exists is returned in missing.
+func resolveUserAccess(ctx context.Context, client *gocloak.GoCloak, accessToken string, record backupRecord) (groupIds []string, realmRoles []gocloak.Role, clientRoles map[string][]gocloak.Role, missing []string) {
+	clientRoles = map[string][]gocloak.Role{}
+
+	for _, group := range record.Groups {
+		if group.ID != nil {
+			if _, err := client.GetGroup(ctx, accessToken, record.Realm, *group.ID); err == nil {
+				groupIds = append(groupIds, *group.ID)
+				continue
+			}
+		}
+		if group.Path != nil {
+			if current, err := client.GetGroupByPath(ctx, accessToken, record.Realm, *group.Path); err == nil && current.ID != nil {
+				groupIds = append(groupIds, *current.ID)
+				continue
+			}
+		}
+		missing = append(missing, "group="+gocloak.PString(group.Path))
+	}
+
+	if record.RoleMappings == nil {
+		return
+	}
+	if record.RoleMappings.RealmMappings != nil {
+		for _, role := range *record.RoleMappings.RealmMappings {
+			current, err := client.GetRealmRole(ctx, accessToken, record.Realm, gocloak.PString(role.Name))
+			if err != nil {
+				missing = append(missing, "realmRole="+gocloak.PString(role.Name))
+				continue
+			}
+			realmRoles = append(realmRoles, *current)
+		}
+	}
+	for clientName, mapping := range record.RoleMappings.ClientMappings {
+		if mapping == nil || mapping.Mappings == nil {
+			continue
+		}
+		clients, err := client.GetClients(ctx, accessToken, record.Realm, gocloak.GetClientsParams{ClientID: gocloak.StringP(clientName)})
+		if err != nil || len(clients) == 0 || clients[0].ID == nil {
+			missing = append(missing, "client="+clientName)
+			continue
+		}
+		idOfClient := *clients[0].ID
+		for _, role := range *mapping.Mappings {
+			current, err := client.GetClientRole(ctx, accessToken, record.Realm, idOfClient, gocloak.PString(role.Name))
+			if err != nil {
+				missing = append(missing, "clientRole="+clientName+"/"+gocloak.PString(role.Name))
+				continue
+			}
+			clientRoles[idOfClient] = append(clientRoles[idOfClient], *current)
+		}
+	}
+	return
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func TestReadBackupRecords(t *testing.T) {
+	in := `{"runId":"1","realm":"delete","user":{"id":"a1","username":"userA"}}
+
+{"runId":"2","realm":"delete","user":{"id":"b2","username":"userB"}}
+`
+	records, err := readBackupRecords(strings.NewReader(in), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, wanted 2", len(records))
+	}
+
+	if _, err := readBackupRecords(strings.NewReader(`{"runId":"1"}`), nil); err == nil {
+		t.Errorf("expected an error for a record without a user")
+	}
+}
+
+func TestFilterBackupRecords(t *testing.T) {
+	records := []backupRecord{
+		{RunID: "1", User: &gocloak.User{ID: gocloak.StringP("a1"), Username: gocloak.StringP("userA")}},
+		{RunID: "1", User: &gocloak.User{ID: gocloak.StringP("b2"), Username: gocloak.StringP("userB")}},
+		{RunID: "2", User: &gocloak.User{ID: gocloak.StringP("c3"), Username: gocloak.StringP("userC")}},
+	}
+
+	tests := []struct {
+		runId string
+		users string
+		want  int
+	}{
+		{"", "", 3},
+		{"1", "", 2},
+		{"", "userA, c3", 2},
+		{"2", "userA", 0},
+	}
+	for _, tt := range tests {
+		got := filterBackupRecords(records, tt.runId, tt.users)
+		if len(got) != tt.want {
+			t.Errorf("runId=%q users=%q got %d, wanted %d", tt.runId, tt.users, len(got), tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+)
+
+// resumeState holds the users a paused run still has to process, so that the resumed run continues
+// with the same users rather than searching again. While deleting, it is also the run's checkpoint,
+// recording how far the search got and the outcome of each user processed.
+type resumeState struct {
+	RunID        string            `json:"runId"`
+	Reason       string            `json:"reason"`
+	URL          string            `json:"url"`
+	Realm        string            `json:"realm"`
+	Cutoff       int64             `json:"cutoff"`
+	CheckAge     bool              `json:"checkAge"`
+	CriteriaHash string            `json:"criteriaHash,omitempty"`
+	Selection    string            `json:"selection,omitempty"`
+	Scanning     bool              `json:"scanning,omitempty"`
+	ScanPosition int               `json:"scanPosition,omitempty"`
+	Users        []userJob         `json:"users"`
+	Processed    map[string]string `json:"processed,omitempty"`
+	planReference
+}
+
+// planReference records the plan a run applies, so that a resumed run is held to the same plan.
+type planReference struct {
+	PlanFile      string `json:"planFile,omitempty"`
+	PlanHash      string `json:"planHash,omitempty"`
+	PlanApprovals int    `json:"planApprovals,omitempty"`
+}
+
+// appliedPlan is the plan this run applies, if any.
+var appliedPlan planReference
+
+func newResumeState(deleteEpochTime int64, checkAge bool) *resumeState {
+	return &resumeState{RunID: runId, URL: *url, Realm: *destinationRealm, Cutoff: deleteEpochTime, CheckAge: checkAge, CriteriaHash: criteriaHash(), Selection: selectionMode(), planReference: appliedPlan}
+}
+
+// resumePath turns a resume token into the resume file. The token is the run id, and the file is
+// kept in the `logDir`, but a path to the file is accepted as well.
+func resumePath(token string) string {
+	if _, err := os.Stat(token); err == nil {
+		return token
+	}
+	return filepath.Join(*logDir, token+".resume.json")
+}
+
+// writeResumeState replaces the resume file in one step, synced to disk first, so a crash never
+// leaves an empty or half written file.
+func writeResumeState(state *resumeState) (string, error) {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	data = append(data, '\n')
+	// The resume file lists the users, so it is encrypted like the backup and list files.
+	if len(outputRecipients) > 0 {
+		if data, err = encryptBytes(data, outputRecipients); err != nil {
+			return "", err
+		}
+	}
+	path := resumePath(state.RunID)
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return path, nil
+}
+
+// readResumeState reads the resume file, with the outcomes in its journal that were not compacted
+// into it. An encrypted resume file is decrypted with the `identityFile`, and is only resumed with
+// `--encryptTo`, so that the new checkpoint is encrypted as well.
+func readResumeState(token string) (*resumeState, error) {
+	path := resumePath(token)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var identities []age.Identity
+	if bytes.HasPrefix(data, []byte(ageHeader)) {
+		if len(outputRecipients) == 0 {
+			return nil, fmt.Errorf("resume file is encrypted, resume with --encryptTo")
+		}
+		if identities, err = loadIdentities(*identityFile); err != nil {
+			return nil, err
+		}
+		if data, err = decryptBytes(data, identities); err != nil {
+			return nil, err
+		}
+	}
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if err := replayJournal(&state, path, identities); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// removeResumeState deletes the resume file, and its journal, once every user in it has been
+// processed.
+func removeResumeState(token string) {
+	if err := os.Remove(resumePath(token)); err != nil {
+		output(WARNING, true, true, "[M]       : unable to remove resume file=%s err=%s", resumePath(token), err)
+	}
+	if err := os.Remove(journalPath(resumePath(token))); err != nil && !os.IsNotExist(err) {
+		output(WARNING, true, true, "[M]       : unable to remove checkpoint journal=%s err=%s", journalPath(resumePath(token)), err)
+	}
+}
+
+// checkTarget refuses to resume a run against another server or realm.
+func (r *resumeState) checkTarget(url string, realm string) error {
+	if r.URL != url || r.Realm != realm {
+		return fmt.Errorf("resume is for url=%s realm=%s, not url=%s realm=%s", r.URL, r.Realm, url, realm)
+	}
+	return nil
+}
+
+// checkPlan re-reads the plan a resumed run applies, and checks it as `--apply` does: the plan is
+// unchanged, for this url and realm, and approved by at least as many approvers as when it was
+// applied. Every user to resume must be in the plan, as it was planned. It returns nil when the run
+// did not apply a plan.
+func (r *resumeState) checkPlan(url string, realm string, required int) (*deletionPlan, error) {
+	if r.PlanFile == "" {
+		return nil, nil
+	}
+	plan, err := readPlan(r.PlanFile)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Hash != r.PlanHash {
+		return nil, fmt.Errorf("plan=%s has changed since runId=%s", r.PlanFile, r.RunID)
+	}
+	if required < r.PlanApprovals {
+		required = r.PlanApprovals
+	}
+	if err := verifyPlan(plan, url, realm, required); err != nil {
+		return nil, err
+	}
+	planned := make(map[string]userJob, len(plan.Users))
+	for _, user := range plan.Users {
+		planned[user.ID] = user
+	}
+	for _, user := range r.Users {
+		if p, ok := planned[user.ID]; !ok || p.Username != user.Username || p.CreatedTimestamp != user.CreatedTimestamp {
+			return nil, fmt.Errorf("user id=%s username=%s is not in plan=%s", user.ID, user.Username, r.PlanFile)
+		}
+	}
+	return plan, nil
+}
+
+// exitWithResume saves the users this run has not processed, and exits with the resume token. A run
+// stopped by a signal exits with its own code, so that a scheduler can tell it apart from a pause.
+func exitWithResume(reason string, remaining []userJob, deleteEpochTime int64, checkAge bool) {
+	state := newResumeState(deleteEpochTime, checkAge)
+	if checkpoint != nil {
+		*state = checkpoint.snapshot()
+	}
+	state.Reason = reason
+	state.Users = remaining
+	state.Scanning = false
+	path, err := writeResumeState(state)
+	if err != nil {
+		log.Println("[M]  error writing resume file: ", err)
+		fmt.Println("[M]  FAIL: error writing resume file: ", err)
+		exitRun(1)
+	}
+	// The outcomes in the journal are all in the resume file now.
+	if err := os.Remove(journalPath(path)); err != nil && !os.IsNotExist(err) {
+		log.Println("[M]  error removing checkpoint journal: ", err)
+	}
+	log.Println("[M]  PAUSED: reason=", reason, " remaining=", len(remaining), " deleted=", deleted, " resume with --resume=", runId, " file=", path)
+	fmt.Println("[M]  PAUSED: reason="+reason+" remaining=", len(remaining), " deleted=", deleted, " resume with --resume="+runId+" file="+path)
+	if reason == "signal" {
+		exitRun(EXIT_INTERRUPTED)
+	}
+	exitRun(EXIT_PAUSED)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestResumeStateRoundTrip(t *testing.T) {
+	saved := *logDir
+	*logDir = t.TempDir()
+	defer func() { *logDir = saved }()
+
+	state := &resumeState{RunID: "1700000000", Reason: "canary", URL: "http://127.0.0.1:8080", Realm: "delete", Cutoff: 1640995200000, CheckAge: true,
+		Users: []userJob{{ID: "a1", Username: "userA", CreatedTimestamp: 1640995100000}}}
+	path, err := writeResumeState(state)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Both the token and the path resume the same run.
+	for _, token := range []string{"1700000000", path} {
+		got, err := readResumeState(token)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got.Cutoff != state.Cutoff || !got.CheckAge || len(got.Users) != 1 || got.Users[0] != state.Users[0] {
+			t.Errorf("token=%s got %+v", token, got)
+		}
+	}
+
+	if err := state.checkTarget("http://127.0.0.1:8080", "master"); err == nil {
+		t.Errorf("expected an error for another realm")
+	}
+
+	removeResumeState("1700000000")
+	if _, err := readResumeState("1700000000"); err == nil {
+		t.Errorf("expected the resume file to be removed")
+	}
+}
+
+func TestResumeChecksPlan(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "plan.json")
+	plan := testPlan()
+	if err := writePlan(path, plan); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	plan, _ = readPlan(path)
+
+	state := &resumeState{RunID: "1700000000", Users: plan.Users,
+		planReference: planReference{PlanFile: path, PlanHash: plan.Hash}}
+	if got, err := state.checkPlan(plan.URL, plan.Realm, 0); err != nil || got == nil {
+		t.Fatalf("checkPlan() = %v, %v", got, err)
+	}
+	if _, err := state.checkPlan(plan.URL, "master", 0); err == nil {
+		t.Errorf("expected an error for another realm")
+	}
+
+	// Users added to the resume file, or changed, are not in the plan.
+	state.Users = append(state.Users, userJob{ID: "b2", Username: "userB"})
+	if _, err := state.checkPlan(plan.URL, plan.Realm, 0); err == nil {
+		t.Errorf("expected a user not in the plan to be refused")
+	}
+	state.Users = []userJob{{ID: "a1", Username: "userA", CreatedTimestamp: 1}}
+	if _, err := state.checkPlan(plan.URL, plan.Realm, 0); err == nil {
+		t.Errorf("expected a user changed from the plan to be refused")
+	}
+	state.Users = plan.Users
+
+	// The approvals required when the plan was applied are still required.
+	state.PlanApprovals = 1
+	if _, err := state.checkPlan(plan.URL, plan.Realm, 0); err == nil {
+		t.Errorf("expected the plan's approvals to be checked again")
+	}
+	state.PlanApprovals = 0
+
+	plan.Users = append(plan.Users, userJob{ID: "b2", Username: "userB"})
+	if err := writePlan(path, plan); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := state.checkPlan(plan.URL, plan.Realm, 0); err == nil {
+		t.Errorf("expected a changed plan to be refused")
+	}
+
+	if got, err := (&resumeState{}).checkPlan(plan.URL, plan.Realm, 0); err != nil || got != nil {
+		t.Errorf("checkPlan() without a plan = %v, %v", got, err)
+	}
+}
+
+func TestEncryptedResumeState(t *testing.T) {
+	savedDir, savedIdentity := *logDir, *identityFile
+	*logDir = t.TempDir()
+	defer func() { *logDir, *identityFile, outputRecipients = savedDir, savedIdentity, nil }()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	*identityFile = filepath.Join(*logDir, "key.txt")
+	os.WriteFile(*identityFile, []byte(identity.String()+"\n"), 0600)
+	outputRecipients = []age.Recipient{identity.Recipient()}
+
+	state := &resumeState{RunID: "1700000000", Users: []userJob{{ID: "0a3b3c1e-8a40-4d5f-9b9a-1c2d3e4f5a6b", Username: "userA"}, {ID: "b2", Username: "userB"}}}
+	c, err := startCheckpoint(state, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.record(state.Users[0], OUTCOME_DELETED)
+	c.journal.Close()
+
+	for _, path := range []string{c.path, journalPath(c.path)} {
+		raw, _ := os.ReadFile(path)
+		if bytes.Contains(raw, []byte("userA")) || bytes.Contains(raw, []byte(state.Users[0].ID)) {
+			t.Errorf("%s is not encrypted: %s", path, raw)
+		}
+	}
+
+	got, err := readResumeState("1700000000")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(got.Users) != 2 || got.Processed[state.Users[0].ID] != OUTCOME_DELETED {
+		t.Errorf("got %+v", got)
+	}
+
+	outputRecipients = nil
+	if _, err := readResumeState("1700000000"); err == nil {
+		t.Errorf("expected an encrypted resume file to need --encryptTo")
+	}
+}
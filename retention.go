@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// retentionRule is a cutoff, or an exemption, and where it was set.
+type retentionRule struct {
+	cutoff int64
+	exempt bool
+	source string
+}
+
+// groupRetention is a rule set on a group, which applies to the group's members.
+type groupRetention struct {
+	rule    retentionRule
+	members map[string]bool
+}
+
+// keycloakRetention works out each user's cutoff. A rule on one of the user's groups wins, then the
+// realm's rule, then `days` or `deleteDate` from the command line.
+// Rules from keycloak never cut off later than minCutoff, so an attribute can not delete users
+// sooner than `minRetentionDays`.
+type keycloakRetention struct {
+	fromKeycloak bool
+	minCutoff    int64
+	cli          *retentionRule
+	realm        *retentionRule
+	groups       []groupRetention
+}
+
+// retention is set when the cutoff comes from keycloak, or the decisions are being explained.
+var retention *keycloakRetention
+
+func newKeycloakRetention(fromKeycloak bool, minCutoff int64, cliCutoff int64, hasCli bool) *keycloakRetention {
+	r := &keycloakRetention{fromKeycloak: fromKeycloak, minCutoff: minCutoff}
+	if hasCli {
+		r.cli = &retentionRule{cutoff: cliCutoff, source: "cli"}
+	}
+	return r
+}
+
+// parseRetention reads a rule from the retention attributes, returning nil when none are set.
+func parseRetention(attributes map[string]string, source string) (*retentionRule, error) {
+	days, date, exempt := attributes[RETENTION_DAYS_ATTRIBUTE], attributes[RETENTION_DATE_ATTRIBUTE], attributes[RETENTION_EXEMPT_ATTRIBUTE]
+	switch {
+	case strings.EqualFold(exempt, "true"):
+		return &retentionRule{exempt: true, source: source}, nil
+	case days != "" && date != "":
+		return nil, fmt.Errorf("%s has both %s and %s", source, RETENTION_DAYS_ATTRIBUTE, RETENTION_DATE_ATTRIBUTE)
+	case days != "":
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s %s=%q is not a number of days", source, RETENTION_DAYS_ATTRIBUTE, days)
+		}
+		return &retentionRule{cutoff: daysToEpoch(n), source: source}, nil
+	case date != "":
+		cutoff, err := parseDateToEpoch(date)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s=%q: %w", source, RETENTION_DATE_ATTRIBUTE, date, err)
+		}
+		return &retentionRule{cutoff: cutoff, source: source}, nil
+	}
+	return nil, nil
+}
+
+// clamp moves a rule's cutoff back to the minCutoff, when it would delete users sooner.
+func (r *keycloakRetention) clamp(rule *retentionRule) *retentionRule {
+	if rule == nil || rule.exempt || rule.cutoff <= r.minCutoff {
+		return rule
+	}
+	output(WARNING, true, true, "[X]       : %s retention=%s is shorter than minRetentionDays, using olderThan %s", rule.source, rule, epochToDateString(r.minCutoff))
+	rule.cutoff = r.minCutoff
+	return rule
+}
+
+// firstValues flattens group attributes, which can have several values, to their first value.
+func firstValues(attributes *map[string][]string) map[string]string {
+	values := map[string]string{}
+	if attributes == nil {
+		return values
+	}
+	for key, value := range *attributes {
+		if len(value) > 0 {
+			values[key] = value[0]
+		}
+	}
+	return values
+}
+
+// load reads the rules from the realm and group attributes.
+func (r *keycloakRetention) load(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string) error {
+	if r == nil || !r.fromKeycloak {
+		return nil
+	}
+	realm, err := client.GetRealm(ctx, accessToken, targetRealm)
+	if err != nil {
+		return err
+	}
+	attributes := map[string]string{}
+	if realm.Attributes != nil {
+		attributes = *realm.Attributes
+	}
+	if r.realm, err = parseRetention(attributes, "realm"); err != nil {
+		return err
+	}
+	r.realm = r.clamp(r.realm)
+
+	var groups []*gocloak.Group
+	const pageSize = 100
+	for first := 0; ; first += pageSize {
+		page, err := client.GetGroups(ctx, accessToken, targetRealm, gocloak.GetGroupsParams{First: gocloak.IntP(first), Max: gocloak.IntP(pageSize), BriefRepresentation: gocloak.BoolP(false)})
+		if err != nil {
+			return err
+		}
+		groups = append(groups, page...)
+		if len(page) < pageSize {
+			break
+		}
+	}
+	return r.loadGroups(ctx, client, accessToken, targetRealm, groups, nil)
+}
+
+// loadGroups reads the rules from the groups and their child groups. A group's rule applies to the
+// members of its child groups as well, so inherited holds the rules of the group's ancestors, by
+// their index in r.groups.
+func (r *keycloakRetention) loadGroups(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, groups []*gocloak.Group, inherited []int) error {
+	for _, group := range groups {
+		path := gocloak.PString(group.Path)
+		rule, err := parseRetention(firstValues(group.Attributes), "group:"+path)
+		if err != nil {
+			return err
+		}
+		applies := inherited
+		if rule = r.clamp(rule); rule != nil {
+			r.groups = append(r.groups, groupRetention{rule: *rule, members: map[string]bool{}})
+			applies = append(append([]int(nil), inherited...), len(r.groups)-1)
+		}
+		if len(applies) > 0 {
+			members, err := groupMembers(ctx, client, accessToken, targetRealm, *group.ID)
+			if err != nil {
+				return fmt.Errorf("group=%s: %w", path, err)
+			}
+			for _, i := range applies {
+				for id := range members {
+					r.groups[i].members[id] = true
+				}
+			}
+		}
+		children, err := childGroups(ctx, client, accessToken, targetRealm, group)
+		if err != nil {
+			return fmt.Errorf("group=%s: %w", path, err)
+		}
+		if err := r.loadGroups(ctx, client, accessToken, targetRealm, children, applies); err != nil {
+			return err
+		}
+		if rule != nil {
+			output(INFO, true, true, "[X]       : group=%s retention=%s members=%d", path, rule, len(r.groups[applies[len(applies)-1]].members))
+		}
+	}
+	return nil
+}
+
+// childGroupsEndpoint returns the endpoint for a group's children.
+func childGroupsEndpoint(baseURL string, realm string, groupID string, legacy bool) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	if legacy {
+		baseURL += "/auth"
+	}
+	return baseURL + "/admin/realms/" + realm + "/groups/" + groupID + "/children"
+}
+
+// childGroups returns the group's child groups. Since keycloak 23 they are not returned with the
+// group, only from the children endpoint, a page at a time. Earlier versions don't have the
+// endpoint, and return them with the group.
+func childGroups(ctx context.Context, client *gocloak.GoCloak, accessToken string, targetRealm string, group *gocloak.Group) ([]*gocloak.Group, error) {
+	var children []*gocloak.Group
+	const pageSize = 100
+	for first := 0; ; first += pageSize {
+		var page []*gocloak.Group
+		resp, err := client.GetRequestWithBearerAuth(ctx, accessToken).
+			SetQueryParams(map[string]string{"first": strconv.Itoa(first), "max": strconv.Itoa(pageSize), "briefRepresentation": "false"}).
+			SetResult(&page).
+			Get(childGroupsEndpoint(*url, targetRealm, *group.ID, *useLegacyKeycloak))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode() == http.StatusNotFound && first == 0 {
+			return subGroups(group), nil
+		}
+		if resp.IsError() {
+			return nil, fmt.Errorf("unable to get child groups: %s", resp.Status())
+		}
+		children = append(children, page...)
+		if len(page) < pageSize {
+			return children, nil
+		}
+	}
+}
+
+// subGroups returns the child groups returned with the group.
+func subGroups(group *gocloak.Group) []*gocloak.Group {
+	if group.SubGroups == nil {
+		return nil
+	}
+	groups := make([]*gocloak.Group, len(*group.SubGroups))
+	for i := range *group.SubGroups {
+		groups[i] = &(*group.SubGroups)[i]
+	}
+	return groups
+}
+
+func (rule retentionRule) String() string {
+	if rule.exempt {
+		return "exempt"
+	}
+	return "olderThan " + epochToDateString(rule.cutoff)
+}
+
+// ruleFor returns the rule for the user. When the user's groups disagree, an exemption wins,
+// otherwise the earliest cutoff, so that no group's members are deleted sooner than it asked.
+func (r *keycloakRetention) ruleFor(userID string) (retentionRule, bool) {
+	var rule *retentionRule
+	for i := range r.groups {
+		group := &r.groups[i]
+		if !group.members[userID] {
+			continue
+		}
+		if group.rule.exempt {
+			return group.rule, true
+		}
+		if rule == nil || group.rule.cutoff < rule.cutoff {
+			rule = &group.rule
+		}
+	}
+	switch {
+	case rule != nil:
+		return *rule, true
+	case r.realm != nil:
+		return *r.realm, true
+	case r.cli != nil:
+		return *r.cli, true
+	}
+	return retentionRule{}, false
+}
+
+// selector selects the users older than their own cutoff. With `explain`, the decision for every
+// user searched is printed, unless the users are only written to encrypted files.
+func (r *keycloakRetention) selector(explain bool) userSelector {
+	return func(user *gocloak.User) (userJob, bool) {
+		rule, ok := r.ruleFor(*user.ID)
+		selected := ok && !rule.exempt && user.CreatedTimestamp != nil && rule.cutoff >= *user.CreatedTimestamp
+		if explain && printUsers() {
+			created := int64(0)
+			if user.CreatedTimestamp != nil {
+				created = *user.CreatedTimestamp
+			}
+			decision := "keep"
+			if selected {
+				decision = "delete"
+			}
+			source := rule.source
+			if !ok {
+				source = "none"
+			}
+			output(INFO, true, true, "[X]       : %s,%s created=%s rule=%s source=%s decision=%s", *user.Username, *user.ID, epochToDateString(created), rule, source, decision)
+		}
+		if !selected {
+			return userJob{}, false
+		}
+		return userJob{ID: *user.ID, Username: *user.Username, CreatedTimestamp: *user.CreatedTimestamp, CutoffSource: rule.source}, true
+	}
+}
+
+// listWithCutoffSource prints the users to delete, with where each user's cutoff came from, and
+// writes them to the `listFile`.
+func listWithCutoffSource(users []userJob) {
+	var list strings.Builder
+	list.WriteString("Username,ID,Source\n")
+	if printUsers() {
+		output(INFO, true, true, "Username,ID,Source")
+	}
+	for _, user := range users {
+		line := user.Username + "," + user.ID + "," + user.CutoffSource
+		if printUsers() {
+			output(INFO, true, true, "%s", line)
+		}
+		list.WriteString(line + "\n")
+	}
+	if *listFile != "" {
+		if err := writeOutputFile(*listFile, []byte(list.String())); err != nil {
+			output(ERROR, true, true, "[O]       : Error writing listFile: %s", err)
+		} else {
+			output(INFO, true, true, "[O]       : listFile=%s encrypted=%t", *listFile, len(outputRecipients) > 0)
+		}
+	}
+	output(INFO, true, true, "[O]       : Identified %d users", len(users))
+}
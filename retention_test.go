@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func TestParseRetention(t *testing.T) {
+	earliest := daysToEpoch(30)
+	rule, err := parseRetention(map[string]string{RETENTION_DAYS_ATTRIBUTE: "30"}, "realm")
+	if err != nil || rule == nil || rule.cutoff < earliest || rule.cutoff > daysToEpoch(30) || rule.source != "realm" {
+		t.Errorf("rule=%+v err=%v", rule, err)
+	}
+	rule, err = parseRetention(map[string]string{RETENTION_DATE_ATTRIBUTE: "2020-01-01"}, "group:/trials")
+	if want, _ := parseDateToEpoch("2020-01-01"); err != nil || rule == nil || rule.cutoff != want {
+		t.Errorf("rule=%+v err=%v", rule, err)
+	}
+	rule, err = parseRetention(map[string]string{RETENTION_EXEMPT_ATTRIBUTE: "true", RETENTION_DAYS_ATTRIBUTE: "30"}, "group:/staff")
+	if err != nil || rule == nil || !rule.exempt {
+		t.Errorf("rule=%+v err=%v", rule, err)
+	}
+	if rule, err := parseRetention(map[string]string{"other": "1"}, "realm"); rule != nil || err != nil {
+		t.Errorf("rule=%+v err=%v, wanted no rule", rule, err)
+	}
+
+	for _, invalid := range []map[string]string{
+		{RETENTION_DAYS_ATTRIBUTE: "thirty"},
+		{RETENTION_DAYS_ATTRIBUTE: "-1"},
+		{RETENTION_DATE_ATTRIBUTE: "01/01/2020"},
+		{RETENTION_DAYS_ATTRIBUTE: "30", RETENTION_DATE_ATTRIBUTE: "2020-01-01"},
+	} {
+		if _, err := parseRetention(invalid, "realm"); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
+
+func TestRetentionRuleFor(t *testing.T) {
+	r := newKeycloakRetention(true, 0, 3000, true)
+	if rule, ok := r.ruleFor("a"); !ok || rule.source != "cli" {
+		t.Errorf("rule=%+v, wanted the command line to be the fallback", rule)
+	}
+
+	r.realm = &retentionRule{cutoff: 2000, source: "realm"}
+	r.groups = []groupRetention{
+		{rule: retentionRule{cutoff: 1000, source: "group:/trials"}, members: map[string]bool{"a": true, "b": true}},
+		{rule: retentionRule{cutoff: 500, source: "group:/partners"}, members: map[string]bool{"b": true}},
+		{rule: retentionRule{exempt: true, source: "group:/staff"}, members: map[string]bool{"c": true, "a": false}},
+	}
+	tests := []struct {
+		id     string
+		source string
+	}{
+		{"a", "group:/trials"},
+		// In two groups, the earliest cutoff wins.
+		{"b", "group:/partners"},
+		{"c", "group:/staff"},
+		{"d", "realm"},
+	}
+	for _, tt := range tests {
+		if rule, ok := r.ruleFor(tt.id); !ok || rule.source != tt.source {
+			t.Errorf("user=%s rule=%+v, wanted source=%s", tt.id, rule, tt.source)
+		}
+	}
+
+	if _, ok := newKeycloakRetention(true, 0, 0, false).ruleFor("a"); ok {
+		t.Errorf("expected no rule without attributes or command line criteria")
+	}
+}
+
+func TestRetentionSelector(t *testing.T) {
+	r := newKeycloakRetention(true, 0, 0, false)
+	r.realm = &retentionRule{cutoff: 2000, source: "realm"}
+	r.groups = []groupRetention{{rule: retentionRule{exempt: true, source: "group:/staff"}, members: map[string]bool{"staff": true}}}
+	selected := r.selector(false)
+
+	user := func(id string, created int64) *gocloak.User {
+		return &gocloak.User{ID: gocloak.StringP(id), Username: gocloak.StringP("user-" + id), CreatedTimestamp: gocloak.Int64P(created)}
+	}
+	job, ok := selected(user("old", 1000))
+	if !ok || job.CutoffSource != "realm" {
+		t.Errorf("job=%+v ok=%t", job, ok)
+	}
+	if _, ok := selected(user("new", 3000)); ok {
+		t.Errorf("expected a user newer than the realm cutoff not to be selected")
+	}
+	if _, ok := selected(user("staff", 1000)); ok {
+		t.Errorf("expected an exempt user not to be selected")
+	}
+}
+
+func TestRetentionClamp(t *testing.T) {
+	r := newKeycloakRetention(true, 2000, 0, false)
+	if rule := r.clamp(&retentionRule{cutoff: 3000, source: "realm"}); rule.cutoff != 2000 {
+		t.Errorf("rule=%+v, wanted the cutoff moved back to the minimum", rule)
+	}
+	if rule := r.clamp(&retentionRule{cutoff: 1000, source: "realm"}); rule.cutoff != 1000 {
+		t.Errorf("rule=%+v, wanted a longer retention kept", rule)
+	}
+	if rule := r.clamp(&retentionRule{exempt: true, source: "group:/staff"}); !rule.exempt {
+		t.Errorf("rule=%+v, wanted the exemption kept", rule)
+	}
+	if rule := r.clamp(nil); rule != nil {
+		t.Errorf("rule=%+v, wanted no rule", rule)
+	}
+}
+
+func TestChildGroups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/realms/delete/groups/parent/children":
+			if r.URL.Query().Get("first") != "0" {
+				t.Errorf("unexpected page first=%s", r.URL.Query().Get("first"))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"id":"child","path":"/parent/child","attributes":{"kcDeleteRetentionExempt":["true"]}}]`))
+		default:
+			// Keycloak before 23 has no children endpoint.
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	saved := *url
+	*url = server.URL
+	defer func() { *url = saved }()
+	client := gocloak.NewClient(server.URL)
+
+	children, err := childGroups(context.Background(), client, "token", "delete", &gocloak.Group{ID: gocloak.StringP("parent")})
+	if err != nil || len(children) != 1 || *children[0].ID != "child" || firstValues(children[0].Attributes)[RETENTION_EXEMPT_ATTRIBUTE] != "true" {
+		t.Errorf("children=%v err=%v", children, err)
+	}
+
+	legacy := &gocloak.Group{ID: gocloak.StringP("legacy"), SubGroups: &[]gocloak.Group{{ID: gocloak.StringP("sub")}}}
+	children, err = childGroups(context.Background(), client, "token", "delete", legacy)
+	if err != nil || len(children) != 1 || *children[0].ID != "sub" {
+		t.Errorf("children=%v err=%v, wanted the subgroups returned with the group", children, err)
+	}
+}
+
+func TestRetentionLoadGroups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/admin/realms/delete":
+			w.Write([]byte(`{"realm":"delete"}`))
+		case "/admin/realms/delete/groups":
+			// A full first page, so the exempt group is only on the second.
+			if r.URL.Query().Get("first") == "0" {
+				var groups []string
+				for i := 0; i < 100; i++ {
+					groups = append(groups, fmt.Sprintf(`{"id":"g%d","path":"/g%d"}`, i, i))
+				}
+				w.Write([]byte("[" + strings.Join(groups, ",") + "]"))
+				return
+			}
+			w.Write([]byte(`[{"id":"staff","path":"/staff","attributes":{"kcDeleteRetentionExempt":["true"]}}]`))
+		case "/admin/realms/delete/groups/staff/children":
+			if r.URL.Query().Get("first") != "0" {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[{"id":"contractors","path":"/staff/contractors"}]`))
+		case "/admin/realms/delete/groups/staff/members":
+			w.Write([]byte(`[{"id":"employee"}]`))
+		case "/admin/realms/delete/groups/contractors/members":
+			w.Write([]byte(`[{"id":"contractor"}]`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer server.Close()
+	saved := *url
+	*url = server.URL
+	defer func() { *url = saved }()
+
+	r := newKeycloakRetention(true, 0, 0, false)
+	if err := r.load(context.Background(), gocloak.NewClient(server.URL), "token", "delete"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The exemption is on the second page of groups, and applies to the members of its child group.
+	for _, id := range []string{"employee", "contractor"} {
+		if rule, ok := r.ruleFor(id); !ok || !rule.exempt || rule.source != "group:/staff" {
+			t.Errorf("user=%s rule=%+v, wanted the staff exemption", id, rule)
+		}
+	}
+	if _, ok := r.ruleFor("other"); ok {
+		t.Errorf("expected no rule for a user in no group")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// secretFlags are the options that hold credentials. Their values, and those of the `headers`, can
+// be a reference to the secret rather than the secret itself, see secretResolver.resolve.
+var secretFlags = []string{"clientSecret", "password", "headerValue", "smtpPassword"}
+
+// secretResolver resolves secret references. Only one secret can be read from stdin, and not when
+// stdin is already used, e.g. by `--fromFile -`.
+type secretResolver struct {
+	stdin       io.Reader
+	stdinUsedBy string
+}
+
+// resolve returns the secret for a value, which is either the secret itself or a reference to it:
+//
+//	file:///run/secrets/kc  the contents of the file
+//	env://NAME              the environment variable
+//	exec://command args     the output of the command, which is run without a shell
+//	stdin://                everything piped to stdin
+//
+// A trailing newline is removed, and an empty secret is an error.
+func (r *secretResolver) resolve(name string, value string) (string, error) {
+	var secret string
+	switch {
+	case strings.HasPrefix(value, "file://"):
+		contents, err := os.ReadFile(strings.TrimPrefix(value, "file://"))
+		if err != nil {
+			return "", err
+		}
+		secret = string(contents)
+	case strings.HasPrefix(value, "env://"):
+		env := strings.TrimPrefix(value, "env://")
+		secret = os.Getenv(env)
+		if secret == "" {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+	case strings.HasPrefix(value, "exec://"):
+		args := strings.Fields(strings.TrimPrefix(value, "exec://"))
+		if len(args) == 0 {
+			return "", fmt.Errorf("exec:// needs a command")
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", args[0], err)
+		}
+		secret = string(out)
+	case value == "stdin://":
+		if r.stdinUsedBy != "" {
+			return "", fmt.Errorf("stdin is already used by %s", r.stdinUsedBy)
+		}
+		r.stdinUsedBy = name
+		contents, err := io.ReadAll(r.stdin)
+		if err != nil {
+			return "", err
+		}
+		secret = string(contents)
+	default:
+		return value, nil
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("the secret is empty")
+	}
+	return secret, nil
+}
+
+// resolveSecrets replaces the secret references in the secretFlags and the headers with the secrets,
+// and redacts the secrets from the output. The flags keep their source, so the output still shows
+// where the reference came from.
+func resolveSecrets(flags *flag.FlagSet, headers map[string]string, r *secretResolver) error {
+	for _, name := range secretFlags {
+		f := flags.Lookup(name)
+		if f == nil {
+			continue
+		}
+		secret, err := r.resolve(name, f.Value.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := f.Value.Set(secret); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		addSecret(secret)
+	}
+	for header, value := range headers {
+		secret, err := r.resolve("headers."+header, value)
+		if err != nil {
+			return fmt.Errorf("headers.%s: %w", header, err)
+		}
+		headers[header] = secret
+		addSecret(secret)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+func TestResolveSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_KC_SECRET", "from-env")
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"file://" + path, "from-file"},
+		{"env://TEST_KC_SECRET", "from-env"},
+		{"exec://echo from-exec", "from-exec"},
+		{"stdin://", "from-stdin"},
+	}
+	for _, tt := range tests {
+		r := &secretResolver{stdin: strings.NewReader("from-stdin\n")}
+		if got, err := r.resolve("clientSecret", tt.value); err != nil || got != tt.want {
+			t.Errorf("resolve(%s)=%s err=%v, want %s", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolveSecretInvalid(t *testing.T) {
+	os.Unsetenv("TEST_KC_UNSET")
+	for _, value := range []string{
+		"file://" + filepath.Join(t.TempDir(), "missing"),
+		"env://TEST_KC_UNSET",
+		"exec://",
+		"exec://false",
+		"stdin://",
+	} {
+		r := &secretResolver{stdin: strings.NewReader("\n")}
+		if _, err := r.resolve("clientSecret", value); err == nil {
+			t.Errorf("expected an error for %s", value)
+		}
+	}
+
+	r := &secretResolver{stdin: strings.NewReader("secret"), stdinUsedBy: "fromFile"}
+	if _, err := r.resolve("clientSecret", "stdin://"); err == nil {
+		t.Errorf("expected an error when stdin is already used")
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	t.Setenv("TEST_KC_SECRET", "client-secret")
+	t.Setenv("TEST_KC_API_KEY", "api-key")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	clientSecret := flags.String("clientSecret", "env://TEST_KC_SECRET", "")
+	headerValue := flags.String("headerValue", "plain", "")
+	headers := map[string]string{"X-Api-Key": "env://TEST_KC_API_KEY"}
+
+	if err := resolveSecrets(flags, headers, &secretResolver{}); err != nil {
+		t.Fatal(err)
+	}
+	if *clientSecret != "client-secret" || *headerValue != "plain" || headers["X-Api-Key"] != "api-key" {
+		t.Errorf("clientSecret=%s headerValue=%s headers=%v", *clientSecret, *headerValue, headers)
+	}
+}
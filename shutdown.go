@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// stopAfterBatch is closed on the first SIGINT of a batched run, so that it stops once the current
+// batch has finished.
+var stopAfterBatch = make(chan struct{})
+
+// shutdownOnSignal stops dispatching users on the first SIGINT or SIGTERM, so the deletions in
+// flight can finish and the run exits with a resume token. If they have not finished within
+// `shutdownTimeout`, or a second signal arrives, the run exits immediately. With `batchSize`, the
+// first SIGINT lets the current batch finish instead, and the next signal stops dispatching.
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 3)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		if sig == os.Interrupt && *batchSize > 0 {
+			output(WARNING, true, true, "[M]       : received %s, stopping after the current batch, signal again to stop now", sig)
+			close(stopAfterBatch)
+			sig = <-signals
+		}
+		output(WARNING, true, true, "[M]       : received %s, waiting up to %s for in-flight deletions, signal again to exit now", sig, *shutdownTimeout)
+		halt("signal")
+
+		select {
+		case sig = <-signals:
+			output(ERROR, true, true, "[M]       : received %s, exiting now, processed=%d deleted=%d", sig, processed, deleted)
+		case <-time.After(*shutdownTimeout):
+			output(ERROR, true, true, "[M]       : in-flight deletions did not finish within %s, exiting now, processed=%d deleted=%d", *shutdownTimeout, processed, deleted)
+		}
+		checkpoint.save()
+		// Releasing a realm lock could hang on an unresponsive server, so it is left to expire.
+		releaseLocalLock()
+		os.Exit(EXIT_FORCED)
+	}()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteLogFlushesResults(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	results := make(chan string, 10)
+	done := make(chan struct{})
+	go writeLog(results, done)
+	for _, result := range []string{"DELETED, alice", "DELETED, bob", "SKIPPED, carol"} {
+		results <- result
+	}
+	close(results)
+	<-done
+
+	if got := strings.Count(buf.String(), "[L] RSLT"); got != 3 {
+		t.Errorf("logged %d results, wanted 3:\n%s", got, buf.String())
+	}
+}
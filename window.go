@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// Embed the timezone database, as the windows builds may not have one.
+	_ "time/tzdata"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maintenanceWindow is a daily time range on some days of the week, in a timezone. A range that
+// ends before it starts crosses midnight, and belongs to the day it starts on.
+type maintenanceWindow struct {
+	days     [7]bool
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+	spec     string
+}
+
+// parseWindow parses `DAYS HH:MM-HH:MM [TIMEZONE]`, where DAYS is a comma separated list of days or
+// day ranges such as `Mon-Fri` or `Sat,Sun`, or `*` for every day.
+func parseWindow(spec string) (*maintenanceWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("window %q is not `DAYS HH:MM-HH:MM [TIMEZONE]`", spec)
+	}
+	w := &maintenanceWindow{location: time.Local, spec: spec}
+
+	if err := w.parseDays(fields[0]); err != nil {
+		return nil, err
+	}
+
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("window time %q is not HH:MM-HH:MM", fields[1])
+	}
+	var err error
+	if w.start, err = parseClock(times[0]); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return nil, err
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("window time %q is empty", fields[1])
+	}
+
+	if len(fields) == 3 {
+		if w.location, err = time.LoadLocation(fields[2]); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *maintenanceWindow) parseDays(spec string) error {
+	if spec == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.Split(strings.ToLower(part), "-")
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("window day %q is not a day", bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("window day %q is not a day", bounds[1])
+			}
+		} else if len(bounds) > 2 {
+			return fmt.Errorf("window days %q is not a day range", part)
+		}
+		// Ranges can wrap around the end of the week, such as Fri-Mon.
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("window time %q is not HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// openingAt returns the start of the window that contains t, if there is one.
+func (w *maintenanceWindow) openingAt(t time.Time) (time.Time, bool) {
+	local := t.In(w.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, w.location)
+	// Today's window, or yesterday's when it crosses midnight.
+	for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		opens := clockOn(day, w.start)
+		closes := clockOn(day, w.end)
+		if w.end < w.start {
+			closes = clockOn(day.AddDate(0, 0, 1), w.end)
+		}
+		if !local.Before(opens) && local.Before(closes) {
+			return opens, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// contains returns true when t is inside the window.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	_, ok := w.openingAt(t)
+	return ok
+}
+
+// closesAfter returns the end of the window that contains t, or false when t is outside the window.
+func (w *maintenanceWindow) closesAfter(t time.Time) (time.Time, bool) {
+	opens, ok := w.openingAt(t)
+	if !ok {
+		return time.Time{}, false
+	}
+	if w.end < w.start {
+		return clockOn(opens.AddDate(0, 0, 1), w.end), true
+	}
+	return clockOn(opens, w.end), true
+}
+
+// clockOn returns the wall clock time on the day, which is not always midnight plus the offset
+// when daylight saving changes that day.
+func clockOn(day time.Time, clock time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// enforceWindow halts the dispatch of users to the workers when the window closes, or straight away
+// when it has already closed.
+func enforceWindow(w *maintenanceWindow, now time.Time) {
+	closes, ok := w.closesAfter(now)
+	if !ok {
+		output(WARNING, true, true, "[M]       : window=%q has already closed, no users will be deleted", w.spec)
+		halt("window")
+		return
+	}
+	output(INFO, true, true, "[M]       : window=%q closes at %s", w.spec, closes.Format(time.RFC3339))
+	time.AfterFunc(closes.Sub(now), func() {
+		halt("window")
+	})
+}
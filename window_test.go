@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	w, err := parseWindow("Mon-Fri 01:00-05:00 Australia/Sydney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.location.String() != "Australia/Sydney" {
+		t.Errorf("location=%s", w.location)
+	}
+	want := [7]bool{false, true, true, true, true, true, false}
+	if w.days != want {
+		t.Errorf("days=%v, want %v", w.days, want)
+	}
+	if w.start != time.Hour || w.end != 5*time.Hour {
+		t.Errorf("start=%s end=%s", w.start, w.end)
+	}
+
+	w, err = parseWindow("Fri-Mon 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = [7]bool{true, true, false, false, false, true, true}
+	if w.days != want {
+		t.Errorf("wrapping days=%v, want %v", w.days, want)
+	}
+
+	w, err = parseWindow("* 02:00-03:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for day, ok := range w.days {
+		if !ok {
+			t.Errorf("day=%d not in window", day)
+		}
+	}
+}
+
+func TestParseWindowInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"Mon-Fri",
+		"Funday 01:00-02:00",
+		"Mon-Fri-Sat 01:00-02:00",
+		"Mon 01:00",
+		"Mon 25:00-02:00",
+		"Mon 01:00-01:00",
+		"Mon 01:00-02:00 Nowhere/Special",
+		"Mon 01:00-02:00 UTC extra",
+	} {
+		if _, err := parseWindow(spec); err == nil {
+			t.Errorf("parseWindow(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	w, err := parseWindow("Mon-Fri 01:00-05:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2024-01-01 is a Monday.
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2024, 1, 1, 0, 59, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 1, 4, 59, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 1, 5, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 6, 2, 0, 0, 0, time.UTC), false},
+		// The window is in UTC, whatever zone the time is in.
+		{time.Date(2024, 1, 1, 12, 0, 0, 0, time.FixedZone("AEST", 10*60*60)), true},
+	}
+	for _, test := range tests {
+		if got := w.contains(test.at); got != test.want {
+			t.Errorf("contains(%s)=%v, want %v", test.at, got, test.want)
+		}
+	}
+}
+
+func TestWindowCrossingMidnight(t *testing.T) {
+	w, err := parseWindow("Fri 22:00-02:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2024-01-05 is a Friday, the window runs into Saturday morning, but not Friday morning.
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2024, 1, 5, 1, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 5, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 6, 1, 59, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 6, 2, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 6, 23, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if got := w.contains(test.at); got != test.want {
+			t.Errorf("contains(%s)=%v, want %v", test.at, got, test.want)
+		}
+	}
+
+	closes, ok := w.closesAfter(time.Date(2024, 1, 5, 23, 0, 0, 0, time.UTC))
+	if want := time.Date(2024, 1, 6, 2, 0, 0, 0, time.UTC); !ok || !closes.Equal(want) {
+		t.Errorf("closesAfter=%s, want %s", closes, want)
+	}
+	closes, ok = w.closesAfter(time.Date(2024, 1, 6, 1, 0, 0, 0, time.UTC))
+	if want := time.Date(2024, 1, 6, 2, 0, 0, 0, time.UTC); !ok || !closes.Equal(want) {
+		t.Errorf("closesAfter=%s, want %s", closes, want)
+	}
+	if closes, ok = w.closesAfter(time.Date(2024, 1, 6, 2, 0, 0, 0, time.UTC)); ok {
+		t.Errorf("closesAfter=%s, expected the window to have closed", closes)
+	}
+}